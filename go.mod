@@ -5,4 +5,8 @@ go 1.13
 require (
 	github.com/blevesearch/bleve v1.0.10
 	github.com/gorilla/websocket v1.4.2
+	github.com/ledongthuc/pdf v0.0.0-20240201131950-da5b75280b06
+	github.com/russross/blackfriday/v2 v2.1.0
+	github.com/santhosh-tekuri/jsonschema/v5 v5.3.1
+	golang.org/x/term v0.0.0-20201126162022-7de9c90e9dd1
 )
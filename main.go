@@ -8,22 +8,28 @@
 package main
 
 import (
+   "bufio"
+   "errors"
    "runtime/debug"
    "flag"
    "fmt"
    "net/http"
    "io"
+   "io/ioutil"
    "encoding/json"
    "mime/multipart"
    "net"
    "os"
    "path"
+   "path/filepath"
    pSl "github.com/networkimprov/mnm-hammer/slib"
    pWs "github.com/gorilla/websocket"
+   pTerm "golang.org/x/term"
    "math/rand"
    "strconv"
    "strings"
    "sync"
+   "syscall"
    "text/template"
    "time"
    "crypto/tls"
@@ -36,12 +42,14 @@ import (
 const kVersionA, kVersionB, kVersionC = 0, 10, 0
 const kVersionDate = "(unreleased)" // yyyy.mm.dd
 
-const kDialRetryDelayMax = 6 * 60
+const kConfigFile = "mnm-hammer.config"
 const kIdleTimeFraction = 10
-const kPulsePeriod time.Duration = 115 * time.Second
 const kMsgHeaderMinLen = int64(len(`{"op":1}`))
 const kMsgHeaderMaxLen = int64(1 << 16)
 const kFirstOhiId = "first_ohi"
+const kErrTmtpRev = "protocol revision not supported"
+const kTmtpFeatureQuit = "quit" // server takes eOpQuit before the client closes the link
+const kAddrPollPeriod = 5 * time.Second // while the server is refused for kErrTmtpRev
 
 const (
    eOpTmtpRev = iota
@@ -59,15 +67,50 @@ var sServicesDoor sync.RWMutex
 var sServices = make(map[string]tService)
 var sServiceTmpl *template.Template
 var sNetAddr string
+var sConfigFile = kConfigFile
+var sStorageDir string
+var sNewSecret bool
+var sFsck, sQuarantine bool
+var sExport string
+var sImport bool
+var sHttps bool
+var sTlsCert, sTlsKey string
+
+// these may be set by the config file
+var sDialRetryDelayMax = 6 * 60
+var sPulsePeriod time.Duration = 115 * time.Second
+
+type tConfig struct {
+   Store string
+   Http string
+   DialRetryMax int // seconds
+   PulsePeriod int // seconds
+   NodeSyncPeriod int // seconds
+   SearchLimit int
+   Https bool
+   TlsCert, TlsKey string // files; if empty, a self-signed certificate is made in Store
+}
 
 func init() {
    flag.StringVar(&sHttpSrvr.Addr, "http", sHttpSrvr.Addr, "[host]:port of http server")
+   flag.StringVar(&sConfigFile, "config", sConfigFile, "json config file; flags take precedence")
+   flag.StringVar(&sStorageDir, "store", sStorageDir, "directory for app data (default store/)")
+   flag.BoolVar(&sNewSecret, "newsecret", sNewSecret,
+                "set or replace the passphrase for browser access, then quit")
+   flag.BoolVar(&sFsck, "fsck", sFsck, "check stored data of services given as arguments (default all), then quit")
+   flag.BoolVar(&sQuarantine, "quarantine", sQuarantine, "with -fsck, move damaged threads out of the store")
+   flag.StringVar(&sExport, "export", sExport,
+                  "write thread to stdout as mbox, eml or html, given service threadId [msgId], then quit")
+   flag.BoolVar(&sImport, "import", sImport, "store mbox file or Maildir as threads, given service path, then quit")
+   flag.BoolVar(&sHttps, "https", sHttps, "serve https; implied by -tlscert")
+   flag.StringVar(&sTlsCert, "tlscert", sTlsCert, "certificate file for https")
+   flag.StringVar(&sTlsKey, "tlskey", sTlsKey, "private key file for https")
 }
 
 func main() {
    aVersionQuit := flag.Bool("version", false, "print version and quit")
    flag.Parse() // may os.Exit(2)
-   if sTestCrash == "" && sTestVerify == "" {
+   if sTestCrash == "" && sTestVerify == "" && sExport == "" {
       fmt.Printf("mnm-hammer tmtp client v%d.%d.%d %s\n", kVersionA, kVersionB, kVersionC, kVersionDate)
    }
    if *aVersionQuit {
@@ -83,12 +126,68 @@ func mainResult() int {
 
    sServices["local"] = tService{ccs: newClientConns()}
 
-   if sTestHost != "" && sHttpSrvr.Addr == ":http" {
-      sHttpSrvr.Addr = ":8123"
+   var aImportPath string
+   if sImport && flag.NArg() == 2 {
+      aImportPath, err = filepath.Abs(flag.Arg(1)) // before _moveToAppDir()
+      if err != nil { return 1 }
+   }
+   if sTestHost == "" {
+      err = _moveToAppDir()
+      if err != nil { return 1 }
+   }
+   err = _loadConfig()
+   if err != nil { return 1 }
+   if sNewSecret {
+      err = _newSecret()
+      if err != nil { return 1 }
+      return 0
+   }
+   if sFsck {
+      pSl.SetStorageDir(sStorageDir)
+      if pSl.FsckService(flag.Args(), sQuarantine) > 0 { return 1 }
+      return 0
+   }
+   if sExport != "" {
+      aArgs := append(flag.Args(), "")
+      if len(aArgs) < 3 || len(aArgs) > 4 {
+         err = tError("-export needs service threadId [msgId]")
+         return 1
+      }
+      pSl.SetStorageDir(sStorageDir)
+      aW := bufio.NewWriter(os.Stdout)
+      err = pSl.ExportService(aW, aArgs[0], sExport, aArgs[1], aArgs[2])
+      if err != nil { return 1 }
+      err = aW.Flush()
+      if err != nil { return 1 }
+      return 0
+   }
+   if sImport {
+      if flag.NArg() != 2 {
+         err = tError("-import needs service path")
+         return 1
+      }
+      pSl.SetStorageDir(sStorageDir)
+      pSl.Init(func(string, string, string, bool) {}, func(string) {}, MsgToSelf, func([]string) {},
+               crashTest) // no network
+      _, err = pSl.ImportService(flag.Arg(0), aImportPath)
+      if err != nil { return 1 }
+      return 0
+   }
+
+   if sTestHost != "" {
+      sHttps = false //todo support https in test.go
+      if sHttpSrvr.Addr == ":http" {
+         sHttpSrvr.Addr = ":8123"
+      }
+   } else if sTlsCert != "" {
+      sHttps = true
+   }
+   if sHttps && sHttpSrvr.Addr == ":http" {
+      sHttpSrvr.Addr = ":https"
    }
    if sHttpSrvr.Addr[0] == ':' {
       sNetAddr = _getNetAddress()
-      if sHttpSrvr.Addr != ":http" {
+      if sHttpSrvr.Addr != ":http" && sHttpSrvr.Addr != ":https" {
          sNetAddr += sHttpSrvr.Addr
       }
    } else {
@@ -98,42 +197,142 @@ func mainResult() int {
    if err != nil { return 1 }
 
    if sTestHost != "" {
+      if sTestHost == kTestRelay {
+         sTransport = sRelay
+      }
       if aRes := test(); aRes >= 0 {
          return aRes
       }
    } else {
-      _, err = os.Stat("web/service.html")
-      if err != nil {
-         err = os.Chdir(path.Dir(os.Args[0]))
-         if err != nil { return 1 }
-      }
-      pSl.Init(StartTrySite, StartService, MsgToSelf, crashTest)
+      pSl.SetStorageDir(sStorageDir)
+      pSl.Init(StartTrySite, StartService, MsgToSelf, ToAllClients, crashTest)
    }
 
    sServiceTmpl, err = template.New("service.html").Delims(`<%`,`%>`).ParseFiles("web/service.html")
    if err != nil { return 1 }
 
-   http.HandleFunc("/"  , runService)
-   http.HandleFunc("/a/", runAbout)
-   http.HandleFunc("/u/", runAuthCallback)
-   http.HandleFunc("/7/", runTokenTest)
-   http.HandleFunc("/l/", runNodeListen)
-   http.HandleFunc("/n/", runNodeRecv)
-   http.HandleFunc("/t/", runGlobal)
-   http.HandleFunc("/f/", runGlobal)
-   http.HandleFunc("/v/", runGlobal)
-   http.HandleFunc("/g/", runTag)
-   http.HandleFunc("/s/", runWebsocket)
-   http.HandleFunc("/5/", runWebsocket) // test clients
+   http.HandleFunc("/"  , checkAccess(runService))
+   http.HandleFunc("/a/", checkAccess(runAbout))
+   http.HandleFunc("/k/", runLogin)
+   http.HandleFunc("/u/", checkAccess(runAuthCallback))
+   http.HandleFunc("/7/", checkAccess(runTokenTest))
+   http.HandleFunc("/l/", checkAccess(runNodeListen))
+   http.HandleFunc("/n/", runNodeRecv) // checks node pin
+   http.HandleFunc("/t/", checkAccess(runGlobal))
+   http.HandleFunc("/f/", checkAccess(runGlobal))
+   http.HandleFunc("/v/", checkAccess(runGlobal))
+   http.HandleFunc("/g/", checkAccess(runTag))
+   http.HandleFunc("/q/", checkAccess(runSearch))
+   http.HandleFunc("/s/", checkAccess(runWebsocket))
+   http.HandleFunc("/5/", checkAccess(runWebsocket)) // test clients
    http.HandleFunc("/w/", runFile)
    http.HandleFunc("/favicon.ico", runFavicon)
 
-   err = sHttpSrvr.Serve(aLsn)
+   if sHttps {
+      if sTlsCert == "" {
+         aHost, _, _ := net.SplitHostPort(sNetAddr)
+         if aHost == "" { aHost = sNetAddr }
+         sTlsCert, sTlsKey, err = pSl.GetCertAccess([]string{"localhost", "127.0.0.1", aHost})
+         if err != nil { return 1 }
+      }
+      err = pSl.SetCertNode(sTlsCert)
+      if err != nil { return 1 }
+      err = sHttpSrvr.ServeTLS(aLsn, sTlsCert, sTlsKey)
+   } else {
+      err = sHttpSrvr.Serve(aLsn)
+   }
    if err != http.ErrServerClosed { return 1 }
    err = nil
    return 0
 }
 
+func _setFlags() map[string]bool {
+   aSet := map[string]bool{}
+   flag.Visit(func(cFlag *flag.Flag) { aSet[cFlag.Name] = true })
+   return aSet
+}
+
+// moves to the app's directory if web/ isn't here, so the default config file and store are
+// found beside the app in every mode; paths given by flags stay relative to the current directory
+func _moveToAppDir() error {
+   _, err := os.Stat("web/service.html")
+   if err == nil {
+      return nil
+   }
+   aSet := _setFlags()
+   for _, aF := range []struct { name string; path *string }{
+                        {"config", &sConfigFile}, {"store", &sStorageDir},
+                        {"tlscert", &sTlsCert}, {"tlskey", &sTlsKey}} {
+      if aSet[aF.name] && *aF.path != "" {
+         *aF.path, err = filepath.Abs(*aF.path)
+         if err != nil { return err }
+      }
+   }
+   return os.Chdir(path.Dir(os.Args[0]))
+}
+
+// relative paths in the config file are relative to its directory
+func _loadConfig() error {
+   aSet := _setFlags()
+   aBuf, err := ioutil.ReadFile(sConfigFile)
+   if err != nil {
+      if os.IsNotExist(err) && !aSet["config"] { return nil } // default file is optional
+      return err
+   }
+   var aCfg tConfig
+   err = json.Unmarshal(aBuf, &aCfg)
+   if err != nil { return tError(sConfigFile +": "+ err.Error()) }
+   fPath := func(c string) string {
+      if filepath.IsAbs(c) { return c }
+      return filepath.Join(filepath.Dir(sConfigFile), c)
+   }
+   if aCfg.Store != "" && !aSet["store"] { sStorageDir = fPath(aCfg.Store) }
+   if aCfg.Http  != "" && !aSet["http"]  { sHttpSrvr.Addr = aCfg.Http }
+   if aCfg.Https && !aSet["https"] { sHttps = true }
+   if aCfg.TlsCert != "" && !aSet["tlscert"] { sTlsCert = fPath(aCfg.TlsCert) }
+   if aCfg.TlsKey  != "" && !aSet["tlskey"]  { sTlsKey  = fPath(aCfg.TlsKey) }
+   if aCfg.DialRetryMax > 0 { sDialRetryDelayMax = aCfg.DialRetryMax }
+   if aCfg.PulsePeriod  > 0 { sPulsePeriod = time.Duration(aCfg.PulsePeriod) * time.Second }
+   if aCfg.NodeSyncPeriod > 0 {
+      pSl.SetSyncPeriodNode(time.Duration(aCfg.NodeSyncPeriod) * time.Second)
+   }
+   pSl.SetLimitSearch(aCfg.SearchLimit)
+   return nil
+}
+
+func _newSecret() error {
+   pSl.SetStorageDir(sStorageDir)
+   fmt.Fprintf(os.Stderr, "new passphrase for browser access (blank line makes a token): ")
+   var aLine string
+   if pTerm.IsTerminal(int(os.Stdin.Fd())) {
+      aBuf, err := pTerm.ReadPassword(int(os.Stdin.Fd())) // doesn't echo
+      fmt.Fprintf(os.Stderr, "\n")
+      if err != nil { return err }
+      aLine = string(aBuf)
+   } else {
+      var err error
+      aLine, err = bufio.NewReader(os.Stdin).ReadString('\n')
+      if err != nil && err != io.EOF { return err }
+   }
+   aSecret, err := pSl.SetSecretAccess(strings.TrimSpace(aLine))
+   if err != nil { return err }
+   if strings.TrimSpace(aLine) == "" {
+      fmt.Printf("access token: %s\n", aSecret)
+   }
+   fmt.Printf("browser sessions must login again\n")
+   return nil
+}
+
+// reports whether iTo is a path on this server, so redirecting to it is safe
+// browsers treat '\' as '/', so "/\evil.com" is rejected as well as "//evil.com"
+func _isLocalPath(iTo string) bool {
+   if len(iTo) == 0 || iTo[0] != '/' || strings.ContainsRune(iTo, '\\') {
+      return false
+   }
+   aUrl, err := url.Parse(iTo)
+   return err == nil && aUrl.Scheme == "" && aUrl.Host == "" && !strings.HasPrefix(aUrl.Path, "//")
+}
+
 func _getNetAddress() string {
    aLink, err := net.Dial("udp", "1.1.1.1:11") // doesn't cause network activity
    if err != nil {
@@ -144,6 +343,37 @@ func _getNetAddress() string {
    return aLink.LocalAddr().(*net.UDPAddr).IP.String()
 }
 
+// tTransport connects to a TMTP server, and carries the packed messages of the link
+type tTransport interface {
+   dial(iDlr *net.Dialer, iAddr string, iVerify bool) (net.Conn, error)
+   read(iConn net.Conn, iBuf []byte) (int, error) // a read may end mid-message
+   write(iConn net.Conn, iBuf []byte) (int, error)
+}
+
+// tConnTransport reads and writes the dialed conn directly
+type tConnTransport struct{}
+
+func (tConnTransport) read(iConn net.Conn, iBuf []byte) (int, error) { return iConn.Read(iBuf) }
+
+func (tConnTransport) write(iConn net.Conn, iBuf []byte) (int, error) { return iConn.Write(iBuf) }
+
+// tLink is the io.ReadWriter of a TMTP conn via sTransport
+type tLink struct { conn net.Conn }
+
+func (o tLink) Read(iBuf []byte) (int, error) { return sTransport.read(o.conn, iBuf) }
+
+func (o tLink) Write(iBuf []byte) (int, error) { return sTransport.write(o.conn, iBuf) }
+
+type tTlsTransport struct{ tConnTransport }
+
+func (tTlsTransport) dial(iDlr *net.Dialer, iAddr string, iVerify bool) (net.Conn, error) {
+   aConn, err := tls.DialWithDialer(iDlr, "tcp", iAddr, &tls.Config{InsecureSkipVerify: !iVerify})
+   if err != nil { return nil, err }
+   return aConn, nil
+}
+
+var sTransport tTransport = tTlsTransport{}
+
 type tService struct {
    queue *tQueue
    ccs *tClientConns
@@ -181,6 +411,10 @@ func MsgToSelf(iSvcId string, iHead *pSl.Header) {
    getService(iSvcId).toSelf <- iHead
 }
 
+func ToAllClients(iResult []string) {
+   toAllClients(iResult)
+}
+
 func getService(iSvcId string) tService {
    sServicesDoor.RLock(); defer sServicesDoor.RUnlock()
    return sServices[iSvcId]
@@ -207,6 +441,7 @@ type tQueue struct {
    buf []*pSl.SendRecord // message queue
    ack chan string // ack queue
    wakeup chan bool // reconnect a periodic service
+   refused chan error // fails a send while the server can't be used
 }
 
 func newQueue(iSvcId string) *tQueue {
@@ -227,6 +462,7 @@ func newQueue(iSvcId string) *tQueue {
       buf: aRecs,
       ack: make(chan string, 2), //todo larger buffer?
       wakeup: make(chan bool),
+      refused: make(chan error),
    }
    go runTmtpSend(aQ)
    if len(aRecs) > 0 {
@@ -238,7 +474,7 @@ func newQueue(iSvcId string) *tQueue {
 func (o *tQueue) postAck(iId string) {
    aMsg := pSl.Msg{"Op":eOpAck, "Id":iId, "Type":"ok"}
    aConn := <-o.connSrc
-   _, err := aConn.Write(packMsg(tMsg(aMsg), nil))
+   _, err := tLink{aConn}.Write(packMsg(tMsg(aMsg), nil))
    if err != nil {
       fmt.Fprintf(os.Stderr, "postAck %s: %s\n", o.service, err)
       //todo maybe aConn.SetDeadline(time.Now()) if pending read doesn't fail
@@ -247,7 +483,7 @@ func (o *tQueue) postAck(iId string) {
 }
 
 func (o *tQueue) _waitForSrec() *pSl.SendRecord {
-   aTmr := time.NewTimer(kPulsePeriod)
+   aTmr := time.NewTimer(sPulsePeriod)
    for {
       select {
       case aSrec := <-o.out:
@@ -256,7 +492,7 @@ func (o *tQueue) _waitForSrec() *pSl.SendRecord {
       case <-aTmr.C:
          select {
          case aConn := <-o.connSrc:
-            _, err := aConn.Write(packMsg(tMsg{"Op":eOpPulse}, nil))
+            _, err := tLink{aConn}.Write(packMsg(tMsg{"Op":eOpPulse}, nil))
             if err != nil {
                fmt.Fprintf(os.Stderr, "_waitForSrec %s: %s\n", o.service, err)
                //todo maybe aConn.SetDeadline(time.Now()) if pending read doesn't fail
@@ -264,7 +500,7 @@ func (o *tQueue) _waitForSrec() *pSl.SendRecord {
             o.connSrc <- aConn
          default:
          }
-         aTmr.Reset(kPulsePeriod)
+         aTmr.Reset(sPulsePeriod)
       }
    }
 }
@@ -273,19 +509,28 @@ func runTmtpSend(o *tQueue) {
    aSrec := o._waitForSrec()
    for {
       var aConn net.Conn
+      var err error
       select {
       case aConn = <-o.connSrc:
+      case err = <-o.refused:
       case o.wakeup <- true:
-         aConn = <-o.connSrc
+         select {
+         case aConn = <-o.connSrc:
+         case err = <-o.refused:
+         }
       }
-      err := pSl.SendService(aConn, o.service, aSrec)
+      if err != nil {
+         aSrec = o._retrySrec(aSrec, err.Error(), false)
+         continue
+      }
+      err = pSl.SendService(tLink{aConn}, o.service, aSrec)
       o.connSrc <- aConn
-      if err != nil { //todo retry transient error
-         if err.Error() == "already sent" {
+      if err != nil {
+         if err.Error() == "already sent" || err.Error() == "cancelled" {
             aSrec = o._waitForSrec()
          } else {
             fmt.Fprintf(os.Stderr, "runTmtpSend %s: send error %s\n", o.service, err.Error())
-            time.Sleep(5 * time.Millisecond)
+            aSrec = o._retrySrec(aSrec, err.Error(), !_isTransient(err))
          }
          continue
       }
@@ -302,10 +547,37 @@ func runTmtpSend(o *tQueue) {
          aSrec = o._waitForSrec()
       case <-aTmr.C:
          fmt.Fprintf(os.Stderr, "runTmtpSend %s: timeout awaiting ack\n", o.service)
+         aSrec = o._retrySrec(aSrec, "timeout awaiting ack", false)
       }
    }
 }
 
+// records a failed send of iSrec, which the queue posts again after a backoff, and returns the
+// next record, so other records needn't wait
+func (o *tQueue) _retrySrec(iSrec *pSl.SendRecord, iErr string, iPermanent bool) *pSl.SendRecord {
+   aTries, aTry := pSl.TryQueue(o.service, iSrec, iErr, iPermanent)
+   if aTry == pSl.QueueFailed {
+      fmt.Fprintf(os.Stderr, "runTmtpSend %s: %s failed after %d tries\n", o.service, iSrec.Id, aTries)
+      aMsg := []string{"ml", "ps", "pf", "cl", "_e", "send failed: "+ iErr}
+      getService(o.service).ccs.Range(func(c *tWsConn) {
+         if !c.test {
+            c.WriteJSON(aMsg)
+         }
+      })
+   }
+   return o._waitForSrec()
+}
+
+// reports whether a send error is due to the link, so resending may succeed
+// other errors are from the record, e.g. a damaged or oversize draft
+func _isTransient(iErr error) bool {
+   if _, ok := iErr.(net.Error); ok {
+      return true
+   }
+   return errors.Is(iErr, io.ErrShortWrite) || errors.Is(iErr, io.ErrClosedPipe) ||
+          errors.Is(iErr, syscall.EPIPE) || errors.Is(iErr, syscall.ECONNRESET)
+}
+
 func runElasticChan(o *tQueue) {
    var aS *pSl.SendRecord
    var ok bool
@@ -338,11 +610,10 @@ Closed:
 
 func runTrySiteRecv(iSvcId string, iAddr string, iVerify bool) {
    aDlr := net.Dialer{Timeout: 8*time.Second}
-   aCfgTls := tls.Config{InsecureSkipVerify: !iVerify}
-   aConn, err := tls.DialWithDialer(&aDlr, "tcp", iAddr, &aCfgTls)
+   aConn, err := sTransport.dial(&aDlr, iAddr, iVerify)
    if err == nil {
       defer aConn.Close()
-      _, err = aConn.Write(packMsg(tMsg{"Op":eOpTmtpRev, "Id":"1"}, nil))
+      _, err = tLink{aConn}.Write(packMsg(tMsg{"Op":eOpTmtpRev, "Id":"1", "Rev":pSl.GetTmtpRevService()}, nil))
       if err == nil {
          err = _readLink(iSvcId, aConn, 8*time.Second)
       }
@@ -387,8 +658,7 @@ func runTmtpRecv(iSvcId string) {
 
       for aWait := 4; true; aWait *= 2 {
          aCfg = pSl.GetConfigService(iSvcId)
-         aCfgTls := tls.Config{InsecureSkipVerify: !aCfg.Verify}
-         aConn, err = tls.DialWithDialer(&aDlr, "tcp", aCfg.Addr, &aCfgTls)
+         aConn, err = sTransport.dial(&aDlr, aCfg.Addr, aCfg.Verify)
          if err == nil {
             break
          }
@@ -398,12 +668,12 @@ func runTmtpRecv(iSvcId string) {
             }
          })
          fmt.Fprintf(os.Stderr, "runTmtpRecv %s: %s\n", iSvcId, err.Error())
-         if aWait > kDialRetryDelayMax { aWait = kDialRetryDelayMax }
+         if aWait > sDialRetryDelayMax { aWait = sDialRetryDelayMax }
          time.Sleep(time.Duration(aWait * 1000 + aRng.Intn(1000) * aWait / 2) * time.Millisecond)
       }
 
-      aMsg := tMsg{"Op":eOpTmtpRev, "Id":"1"}
-      aConn.Write(packMsg(aMsg, nil))
+      aMsg := tMsg{"Op":eOpTmtpRev, "Id":"1", "Rev":pSl.GetTmtpRevService()}
+      tLink{aConn}.Write(packMsg(aMsg, nil))
       if aCfg.Uid == "" {
          aMsg = tMsg{"Op":eOpRegister, "NewAlias":aCfg.Alias, "NewNode":"x"}
          if aCfg.Oidc != nil {
@@ -412,9 +682,12 @@ func runTmtpRecv(iSvcId string) {
       } else {
          aMsg = tMsg{"Op":eOpLogin, "Uid":aCfg.Uid, "Node":aCfg.Node}
       }
-      aConn.Write(packMsg(aMsg, nil)) // on error, assume aConn.Read() fails
+      tLink{aConn}.Write(packMsg(aMsg, nil)) // on error, assume aConn.Read() fails
 
       err = _readLink(iSvcId, aConn, time.Duration(aCfg.LoginPeriod / kIdleTimeFraction) * time.Second)
+      if err == nil && pSl.HasFeatureService(iSvcId, kTmtpFeatureQuit) { // idle timeout
+         tLink{aConn}.Write(packMsg(tMsg{"Op":eOpQuit}, nil))
+      }
       aConn.Close()
 
       aLogoutMsg := pSl.LogoutService(iSvcId)
@@ -425,6 +698,24 @@ func runTmtpRecv(iSvcId string) {
       })
       if err != nil {
          fmt.Fprintf(os.Stderr, "runTmtpRecv %s: %s\n", iSvcId, err)
+         if err.Error() == kErrTmtpRev {
+            // retrying can't succeed; sends fail back to the queue until the address changes
+            aErrMsg := pSl.ErrorService(tError(kErrTmtpRev +"; not reconnecting until address changes"))
+            aSvc.ccs.Range(func(c *tWsConn) {
+               if !c.test {
+                  c.WriteJSON(aErrMsg)
+               }
+            })
+            aPoll := time.NewTicker(kAddrPollPeriod)
+            for pSl.GetConfigService(iSvcId).Addr == aCfg.Addr {
+               select {
+               case <-aPoll.C:
+               case aSvc.queue.refused <- err:
+               }
+            }
+            aPoll.Stop()
+            continue
+         }
          time.Sleep(2 * time.Minute) // don't barrage server if error not transient
       }
    }
@@ -463,7 +754,7 @@ func _readLink(iSvcId string, iConn net.Conn, iIdleMax time.Duration) error {
          if iIdleMax > 0 {
             iConn.SetReadDeadline(time.Now().Add(iIdleMax))
          }
-         aLen, err = iConn.Read(aBuf[aPos:])
+         aLen, err = sTransport.read(iConn, aBuf[aPos:])
          aReadFlag <- true
       }
    }()
@@ -474,7 +765,11 @@ func _readLink(iSvcId string, iConn net.Conn, iIdleMax time.Duration) error {
    WaitForMsg:
       select {
       case aHd := <-aSvc.toSelf:
-         fNotify(pSl.HandleTmtpService(iSvcId, aHd, nil))
+         aFn, aToAll, err := _handleTmtp(iSvcId, aHd, nil)
+         if err != nil {
+            fmt.Fprintf(os.Stderr, "_readLink %s: %s\n", iSvcId, err)
+         }
+         fNotify(aFn, aToAll)
          goto WaitForMsg
       case <-aReadFlag:
       }
@@ -540,14 +835,14 @@ func _readLink(iSvcId string, iConn net.Conn, iIdleMax time.Duration) error {
       }
       if aHead.Op == "tmtprev" && iSvcId[0] == '\x00' { //todo more specific svcid test
          aSvc.ccs.Range(func(c *tWsConn) { // has only one member
-            c.state.SetSiteData(aHead.Name, aHead.Auth, aHead.AuthBy)
+            c.state.SetSiteData(aHead.Name, aHead.Rev, aHead.RevMin, aHead.Auth, aHead.AuthBy)
          })
          return nil
       } else if aHead.Op == "ack" && aHead.Id == kFirstOhiId {
          // no-op
       } else {
          if aHead.Op == "info" && aHead.Info == "login ok" {
-            pSl.SendAllOhi(iConn, iSvcId, kFirstOhiId)
+            pSl.SendAllOhi(tLink{iConn}, iSvcId, kFirstOhiId)
             aLogin = true
             aSvc.queue.connSrc <- iConn
          } else if aHead.Op == "ack" {
@@ -558,9 +853,16 @@ func _readLink(iSvcId string, iConn net.Conn, iIdleMax time.Duration) error {
             }
          }
          if aHead.SubHead == nil || !aHead.SubHead.NodeSync {
-            fNotify(pSl.HandleTmtpService(iSvcId, aHead, &tTmtpInput{aData, iConn}))
+            aFn, aToAll, err := _handleTmtp(iSvcId, aHead, &tTmtpInput{aData, tLink{iConn}})
+            fNotify(aFn, aToAll)
+            if err != nil {
+               return fErr(err.Error()) // not acked; server resends after reconnect
+            }
          } else {
-            pSl.HandleSyncService(iSvcId, aHead, &tTmtpInput{aData, iConn}, fNotify)
+            pSl.HandleSyncService(iSvcId, aHead, &tTmtpInput{aData, tLink{iConn}}, fNotify)
+         }
+         if aHead.Op == "tmtprev" && !pSl.CheckTmtpRevService(iSvcId) {
+            return fErr(kErrTmtpRev)
          }
          if aHead.From != "" && aHead.Id != "" {
             aSvc.queue.postAck(aHead.Id)
@@ -575,6 +877,19 @@ func _readLink(iSvcId string, iConn net.Conn, iIdleMax time.Duration) error {
    }
 }
 
+// calls HandleTmtpService, returning an error if it found damaged data
+func _handleTmtp(iSvcId string, iHead *pSl.Header, iR io.Reader) (
+                 aFn func(*pSl.ClientState)[]string, aToAll []string, err error) {
+   defer func() {
+      err = pSl.RecoverDamage(iSvcId, recover())
+      if err != nil {
+         aFn, aToAll = func(*pSl.ClientState) []string { return []string{"dl", "_e", err.Error()} }, nil
+      }
+   }()
+   aFn, aToAll = pSl.HandleTmtpService(iSvcId, iHead, iR)
+   return
+}
+
 type tTmtpInput struct {
    Buf []byte
    R io.Reader
@@ -595,6 +910,7 @@ func (o *tTmtpInput) Read(iOut []byte) (int, error) {
 
 var kStateOp = map[string]bool{
    "cs":true, "cl":true, "al":true, "ml":true, "tl":true, "mo":true, "mn":true, "an":true, "ad":true,
+   "xm":true, "xh":true, "xe":true,
 }
 
 func runService(iResp http.ResponseWriter, iReq *http.Request) {
@@ -627,6 +943,18 @@ func runService(iResp http.ResponseWriter, iReq *http.Request) {
    }
    iResp.Header().Set("Content-Type", "text/plain; charset=utf-8")
    var aResult interface{}
+   defer func() {
+      err := pSl.RecoverDamage(aSvcId, recover())
+      if err == nil { return }
+      fmt.Fprintf(os.Stderr, "runService %s: op %s %s\n", aSvcId, aOp_Id[0], err)
+      iResp.WriteHeader(http.StatusNotAcceptable) // no effect if output began
+      json.NewEncoder(iResp).Encode(err.Error())
+      getService(aSvcId).ccs.Range(func(c *tWsConn) {
+         if !c.test {
+            c.WriteJSON([]string{"dl"})
+         }
+      })
+   }()
 
    switch aOp_Id[0] {
    case "": // service template
@@ -654,9 +982,11 @@ func runService(iResp http.ResponseWriter, iReq *http.Request) {
    case "cs": aResult = aState.GetSummary()
    case "sd": aResult = pSl.GetSiteDataService(aSvcId)
    case "cf": aResult = pSl.GetCfService(aSvcId)
+   case "ss": aResult = pSl.GetSavedService(aSvcId)
    case "cn": aResult = pSl.GetCnNode(aSvcId)
    case "nl": aResult = pSl.GetIdxNotice(aSvcId)
    case "fl": aResult = pSl.GetIdxFilledForm(aSvcId)
+   case "fq": aResult, err = pSl.QueryFilledForm(aSvcId, aOp_Id[1])
    case "ps": aResult = pSl.GetDraftAdrsbk(aSvcId)
    case "pt": aResult = pSl.GetSentAdrsbk(aSvcId)
    case "pf": aResult = pSl.GetReceivedAdrsbk(aSvcId)
@@ -666,6 +996,8 @@ func runService(iResp http.ResponseWriter, iReq *http.Request) {
    case "cl": aResult = pSl.GetCcThread(aSvcId, aState)
    case "al": aResult = pSl.GetIdxAttach(aSvcId, aState)
    case "ml": aResult = pSl.GetIdxThread(aSvcId, aState)
+   case "sq": aResult = pSl.GetIdxQueue(aSvcId)
+   case "dl": aResult = pSl.GetIdxDamage(aSvcId)
    case "tl":
       err = pSl.WriteResultSearch(iResp, aSvcId, aState)
    case "mo":
@@ -676,6 +1008,21 @@ func runService(iResp http.ResponseWriter, iReq *http.Request) {
          break
       }
       err = pSl.WriteMessagesThread(iResp, aSvcId, aState, aOp_Id[1])
+   case "xm", "xh", "xe":
+      aFormat, aType := "mbox", "application/mbox"
+      if aOp_Id[0] == "xh" { aFormat, aType = "html", "text/html; charset=utf-8" }
+      if aOp_Id[0] == "xe" { aFormat, aType = "eml", "message/rfc822" }
+      iResp.Header().Set("Content-Type", aType)
+      iResp.Header().Set("Content-Disposition", "attachment") // client sets filename
+      err = pSl.WriteThreadExport(iResp, aSvcId, aState, aFormat, aOp_Id[1])
+   case "xc", "xx":
+      aFormat, aType := "csv", "text/csv; charset=utf-8"
+      if aOp_Id[0] == "xx" {
+         aFormat, aType = "xlsx", "application/vnd.openxmlformats-officedocument.spreadsheetml.sheet"
+      }
+      iResp.Header().Set("Content-Type", aType)
+      iResp.Header().Set("Content-Disposition", "attachment") // client sets filename
+      err = pSl.WriteFormExport(iResp, aSvcId, aFormat, aOp_Id[1])
    case "an", "ad":
       aDelim := strings.IndexByte(aOp_Id[1], '_')
       if aDelim < 0 || len(aOp_Id[1]) <= aDelim+3 {
@@ -708,6 +1055,63 @@ func runService(iResp http.ResponseWriter, iReq *http.Request) {
    }
 }
 
+func checkAccess(iFn http.HandlerFunc) http.HandlerFunc {
+   return func(iResp http.ResponseWriter, iReq *http.Request) {
+      if pSl.IsOnAccess() {
+         aCookie, err := iReq.Cookie("session")
+         if err != nil || !pSl.CheckSessionAccess(aCookie.Value) {
+            if iReq.Method == "GET" && strings.Contains(iReq.Header.Get("Accept"), "text/html") {
+               http.Redirect(iResp, iReq, "/k/?"+ url.QueryEscape(iReq.URL.RequestURI()),
+                             http.StatusSeeOther)
+            } else {
+               iResp.WriteHeader(http.StatusUnauthorized)
+            }
+            return
+         }
+      }
+      iFn(iResp, iReq)
+   }
+}
+
+func runLogin(iResp http.ResponseWriter, iReq *http.Request) {
+   if sTestHost == "" {
+      fmt.Printf("runLogin %s %s\n", iReq.Method, iReq.URL.Path)
+   }
+   aStatus := http.StatusOK
+   if iReq.Method == "POST" {
+      aSession := pSl.LoginAccess(iReq.PostFormValue("secret"))
+      if aSession != "" {
+         http.SetCookie(iResp, &http.Cookie{Name: "session", Value: aSession, Path: "/",
+                                            HttpOnly: true, Secure: sHttps, SameSite: http.SameSiteLaxMode,
+                                            MaxAge: 30 * 24 * 60 * 60})
+         aTo := iReq.PostFormValue("r")
+         if !_isLocalPath(aTo) {
+            aTo = "/"
+         }
+         http.Redirect(iResp, iReq, aTo, http.StatusSeeOther)
+         return
+      }
+      fmt.Fprintf(os.Stderr, "runLogin: failed from %s\n", iReq.RemoteAddr)
+      time.Sleep(time.Second) // slow guessing
+      aStatus = http.StatusUnauthorized
+   } else if iReq.Method != "GET" {
+      iResp.WriteHeader(http.StatusMethodNotAllowed)
+      return
+   }
+   aTo, _ := url.QueryUnescape(iReq.URL.RawQuery)
+   if iReq.Method == "POST" {
+      aTo = iReq.PostFormValue("r")
+   }
+   iResp.Header().Set("Content-Type", "text/html")
+   iResp.WriteHeader(aStatus)
+   iResp.Write([]byte(`<html><head></head><body style="text-align:center; font-family:sans-serif">` +
+                      `<form method="POST" action="/k/"><h1>mnm</h1>` +
+                      `<input type="hidden" name="r" value="` +
+                         template.HTMLEscapeString(aTo) + `">` +
+                      `<input type="password" name="secret" placeholder="passphrase" autofocus>` +
+                      `<button type="submit">Login</button></form></body></html>`))
+}
+
 func runAbout(iResp http.ResponseWriter, iReq *http.Request) {
    if sTestHost == "" {
       fmt.Printf("runAbout %s %s\n", iReq.Method, iReq.URL.Path)
@@ -797,7 +1201,8 @@ func runNodeListen(iResp http.ResponseWriter, iReq *http.Request) {
       aToAll := pSl.ListenNode()
       toAllClients(aToAll)
    } else {
-      err := json.NewEncoder(iResp).Encode(pSl.GetPinNode(sNetAddr))
+      aAddr := sNetAddr; if sHttps { aAddr = "https://"+ aAddr } // tells peer to use https
+      err := json.NewEncoder(iResp).Encode(pSl.GetPinNode(aAddr))
       if err != nil { fmt.Fprintf(os.Stderr, "runListen: %v\n", err) }
    }
 }
@@ -913,6 +1318,17 @@ func runTag(iResp http.ResponseWriter, iReq *http.Request) {
    if err != nil { fmt.Fprintf(os.Stderr, "runTag: %v\n", err) }
 }
 
+// searches all services; params are t (terms), o (page offset), s (sort)
+func runSearch(iResp http.ResponseWriter, iReq *http.Request) {
+   if sTestHost == "" {
+      fmt.Printf("runSearch %s %s\n", iReq.Method, iReq.URL.RequestURI())
+   }
+   aParam := iReq.URL.Query()
+   aOffset, _ := strconv.Atoi(aParam.Get("o"))
+   err := pSl.WriteResultGlobalSearch(iResp, aParam.Get("t"), aOffset, aParam.Get("s"))
+   if err != nil { fmt.Fprintf(os.Stderr, "runSearch: %v\n", err) }
+}
+
 var kWsInit = pWs.Upgrader{ReadBufferSize: 1024, WriteBufferSize: 1024}
 
 func runWebsocket(iResp http.ResponseWriter, iReq *http.Request) {
@@ -1055,6 +1471,18 @@ func packMsg(iJso tMsg, iData []byte) []byte {
    return aBuf
 }
 
+func readPackedMsg(iR io.Reader, iHead interface{}) error {
+   aLen := make([]byte, 4)
+   _, err := io.ReadFull(iR, aLen)
+   if err != nil { return err }
+   aUi, err := strconv.ParseUint(string(aLen), 16, 0)
+   if err != nil { return err }
+   aBuf := make([]byte, aUi)
+   _, err = io.ReadFull(iR, aBuf)
+   if err != nil { return err }
+   return json.Unmarshal(aBuf, iHead)
+}
+
 func escapeFile(i string) string {
    if i == ".." || i == "." || pSl.IsReservedFile(i) {
       return i + url.QueryEscape("\u25a1")
@@ -16,6 +16,9 @@ func TestCoverage(i *testing.T) {
    if sTestCrash == "" && sTestVerify == "" {
       fmt.Printf("code coverage for v%d.%d.%d %s\n", kVersionA, kVersionB, kVersionC, kVersionDate)
    }
+   if sTestHost == "" {
+      sTestHost = kTestRelay
+   }
    sTestExit = true
    if mainResult() != 0 {
       i.Fail()
@@ -0,0 +1,519 @@
+// Copyright 2017, 2019 Liam Breck
+// Published at https://github.com/networkimprov/mnm-hammer
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/
+
+package main
+
+import (
+   "bufio"
+   "crypto/rand"
+   "encoding/hex"
+   "encoding/json"
+   "fmt"
+   "io"
+   "io/ioutil"
+   "net"
+   "os"
+   "sync"
+   "time"
+)
+
+// an in-process TMTP server for the test sequence; select it with -test relay
+
+const kTestRelay = "relay"
+const kRelayFile = "tmtp-relay.json" // in test directory, so -crash & -verify runs share state
+const kRelaySiteName = "Test Site"
+const kRelayRev = 1 // protocol revision
+const kRelayAddrRevNext = "rev-next" // dial address for a site that requires a newer revision
+const kRelayLatency = 100 * time.Millisecond // test sequence expects a remote server
+const kRelayDate = "2006-01-02T15:04:05.000Z07:00" // fixed width; posts within a second must sort
+
+type tRelay struct {
+   tConnTransport
+   sync.Mutex // protects the following
+   User map[string]*tRelayUser // key uid
+   Alias map[string]string // key alias, value uid
+   Group map[string]*tRelayGroup // key gid
+   Ohi map[string]map[string]bool // key uid, value set of uids notified of its presence
+   LastMsgId uint64 // clients order a thread's messages by id
+   conns map[string]*tRelayConn // key nodeid
+   revNext map[string]bool // key client address of conn dialed with kRelayAddrRevNext
+   lsn net.Listener
+   start sync.Once
+}
+
+type tRelayUser struct {
+   Node map[string]*tRelayNode // key nodeid
+}
+
+type tRelayNode struct {
+   Name string
+   Queue []*tRelayMsg // awaiting ack
+}
+
+type tRelayMsg struct {
+   Head tMsg
+   Data []byte
+}
+
+type tRelayGroup struct {
+   Member map[string]string // key uid, value alias
+   Invite map[string]string // key alias, value uid
+}
+
+type tRelayConn struct {
+   uid, node string
+   conn net.Conn
+   out chan []byte
+   done chan struct{} // closed when writer quits
+}
+
+// doesn't block after the writer quits on error
+func (o *tRelayConn) send(iMsg []byte) {
+   select {
+   case o.out <- iMsg:
+   case <-o.done:
+   }
+}
+
+// client message header
+type tRelayIn struct {
+   Op int
+   Id string
+   Uid, Node string
+   NewNode, NewAlias string
+   For []tRelayFor
+   ForNotSelf bool
+   NoteFor []tRelayFor
+   NoteLen, NoteHead int64
+   Type string
+   To, From string
+   Gid, Act string
+   DataLen, DataHead int64
+}
+
+type tRelayFor struct {
+   Id string
+   Type int8
+}
+
+const ( _ int8 = iota; eRelayForUser; eRelayForGroupAll; eRelayForGroupExcl; eRelayForSelf )
+
+var sRelay = &tRelay{}
+
+func (o *tRelay) dial(iDlr *net.Dialer, iAddr string, iVerify bool) (net.Conn, error) {
+   o.start.Do(o._start)
+   aConn, err := iDlr.Dial("tcp", o.lsn.Addr().String())
+   if err == nil && iAddr == kRelayAddrRevNext {
+      o.Lock()
+      o.revNext[aConn.LocalAddr().String()] = true
+      o.Unlock()
+   }
+   return aConn, err
+}
+
+func (o *tRelay) _start() {
+   o.User  = map[string]*tRelayUser{}
+   o.Alias = map[string]string{}
+   o.Group = map[string]*tRelayGroup{}
+   o.Ohi   = map[string]map[string]bool{}
+   o.conns = map[string]*tRelayConn{}
+   o.revNext = map[string]bool{}
+   aBuf, err := ioutil.ReadFile(kRelayFile)
+   if err == nil {
+      err = json.Unmarshal(aBuf, o)
+   }
+   if err != nil && !os.IsNotExist(err) { quit(err) }
+   o.lsn, err = net.Listen("tcp", "127.0.0.1:0")
+   if err != nil { quit(err) }
+   go func() {
+      for {
+         aConn, err := o.lsn.Accept()
+         if err != nil { quit(err) }
+         go o._runConn(aConn)
+      }
+   }()
+}
+
+func (o *tRelay) _save() {
+   aBuf, err := json.Marshal(o)
+   if err != nil { quit(err) }
+   err = ioutil.WriteFile(kRelayFile +".tmp", aBuf, 0600)
+   if err != nil { quit(err) }
+   err = os.Rename(kRelayFile +".tmp", kRelayFile)
+   if err != nil { quit(err) }
+}
+
+func (o *tRelay) _runConn(iConn net.Conn) {
+   aC := &tRelayConn{conn: iConn, out: make(chan []byte, 256), done: make(chan struct{})}
+   go func() {
+      for aMsg := range aC.out {
+         time.Sleep(kRelayLatency)
+         _, err := iConn.Write(aMsg)
+         if err != nil { break }
+      }
+      close(aC.done)
+      iConn.Close()
+   }()
+   defer func() {
+      o.Lock(); defer o.Unlock()
+      if aC.node != "" && o.conns[aC.node] == aC {
+         aLast := true
+         for _, cC := range o.conns {
+            aLast = aLast && (cC == aC || cC.uid != aC.uid)
+         }
+         if aLast {
+            o._notifyOhi(aC.uid, 2) // before delete, as _sendOhi() requires sender online
+         }
+         delete(o.conns, aC.node)
+      }
+      delete(o.revNext, iConn.RemoteAddr().String())
+      close(aC.out)
+   }()
+   aR := bufio.NewReader(iConn)
+   for {
+      var aIn tRelayIn
+      err := readPackedMsg(aR, &aIn)
+      if err != nil {
+         if err != io.EOF {
+            fmt.Fprintf(os.Stderr, "relay: %v\n", err)
+         }
+         return
+      }
+      aData := make([]byte, aIn.DataLen)
+      _, err = io.ReadFull(aR, aData)
+      if err != nil {
+         fmt.Fprintf(os.Stderr, "relay: %v\n", err)
+         return
+      }
+      if aIn.Op != eOpTmtpRev && aIn.Op != eOpRegister && aIn.Op != eOpLogin && aC.node == "" {
+         aC.send(packMsg(tMsg{"Op":"quit", "Error":"not logged in"}, nil))
+         return
+      }
+      if !o._handle(aC, &aIn, aData) {
+         return
+      }
+   }
+}
+
+func (o *tRelay) _handle(iC *tRelayConn, iIn *tRelayIn, iData []byte) bool {
+   o.Lock(); defer o.Unlock()
+   aMsgId, aPosted := o._makeMsgId(), time.Now().UTC().Format(kRelayDate) // ack & resulting messages share these
+   fAck := func(cErr string) {
+      cMsg := tMsg{"Op":"ack", "Id":iIn.Id}
+      if cErr != "" {
+         cMsg["Error"] = cErr
+      } else {
+         cMsg["MsgId"], cMsg["Posted"] = aMsgId, aPosted
+      }
+      iC.send(packMsg(cMsg, nil))
+   }
+   fMsg := func(cOp string) tMsg {
+      return tMsg{"Op":cOp, "Id":aMsgId, "From":iC.uid, "Posted":aPosted}
+   }
+
+   switch iIn.Op {
+   case eOpTmtpRev:
+      aRev, aRevMin := kRelayRev, 1
+      if o.revNext[iC.conn.RemoteAddr().String()] {
+         aRev, aRevMin = kRelayRev+1, kRelayRev+1
+      }
+      iC.send(packMsg(tMsg{"Op":"tmtprev", "Id":iIn.Id, "Name":kRelaySiteName,
+                           "Rev":aRev, "RevMin":aRevMin, "Feature":[]string{kTmtpFeatureQuit}, "Auth":1,
+                           "AuthBy":[]tMsg{{"Label":"Test",
+                                            "Login":[]string{"http://localhost/login", "client_id=test"},
+                                            "Token":[]string{"http://localhost/token", "client_id=test"}}}},
+                      nil))
+   case eOpRegister:
+      if iIn.NewAlias != "" && o.Alias[iIn.NewAlias] != "" {
+         iC.send(packMsg(tMsg{"Op":"registered", "Error":"alias taken"}, nil))
+         return false
+      }
+      aUidBuf := make([]byte, 20)
+      _, err := rand.Read(aUidBuf)
+      if err != nil { quit(err) }
+      iC.uid, iC.node = kTestBase32.EncodeToString(aUidBuf), _makeIdRelay(8)
+      o.User[iC.uid] = &tRelayUser{Node: map[string]*tRelayNode{iC.node: {Name: iIn.NewNode}}}
+      if iIn.NewAlias != "" {
+         o.Alias[iIn.NewAlias] = iC.uid
+      }
+      o._save()
+      iC.send(packMsg(tMsg{"Op":"registered", "Uid":iC.uid, "NodeId":iC.node}, nil))
+      o._login(iC)
+   case eOpLogin:
+      aUser := o.User[iIn.Uid]
+      if aUser == nil || aUser.Node[iIn.Node] == nil {
+         iC.send(packMsg(tMsg{"Op":"quit", "Error":"login failed"}, nil))
+         return false
+      }
+      iC.uid, iC.node = iIn.Uid, iIn.Node
+      o._login(iC)
+   case eOpUserEdit:
+      aUser := o.User[iC.uid]
+      var aMsg tMsg
+      if iIn.NewAlias != "" {
+         if o.Alias[iIn.NewAlias] != "" {
+            fAck("alias taken")
+            break
+         }
+         o.Alias[iIn.NewAlias] = iC.uid
+         aMsg = fMsg("user")
+         aMsg["NewAlias"] = iIn.NewAlias
+      } else if iIn.NewNode != "" {
+         aMsg = fMsg("user")
+         aMsg["NewNode"], aMsg["NodeId"] = iIn.NewNode, _makeIdRelay(8)
+      } else {
+         fAck("newnode or newalias required")
+         break
+      }
+      fAck("")
+      o._post(_nodesRelay(aUser, ""), aMsg, nil)
+      if iIn.NewNode != "" {
+         aUser.Node[aMsg["NodeId"].(string)] = &tRelayNode{Name: iIn.NewNode}
+      }
+      o._save()
+   case eOpOhiEdit:
+      aSet := o.Ohi[iC.uid]
+      if aSet == nil || iIn.Type == "init" {
+         aSet = map[string]bool{}
+         o.Ohi[iC.uid] = aSet
+      }
+      for _, aF := range iIn.For {
+         if iIn.Type == "drop" {
+            delete(aSet, aF.Id)
+            o._sendOhi(iC.uid, aF.Id, 2)
+         } else {
+            aSet[aF.Id] = true
+            o._sendOhi(iC.uid, aF.Id, 1)
+         }
+      }
+      fAck("")
+      if iIn.Type != "init" {
+         aMsg := fMsg("ohiedit")
+         aMsg["For"], aMsg["Type"] = iIn.For, iIn.Type
+         o._post(_nodesRelay(o.User[iC.uid], ""), aMsg, nil)
+      }
+      o._save()
+   case eOpGroupInvite, eOpPing:
+      aTo := o.Alias[iIn.To]
+      if aTo == "" {
+         fAck("alias not found: "+ iIn.To)
+         break
+      }
+      aMsg := fMsg("ping")
+      aMsg["To"], aMsg["Alias"], aMsg["DataLen"] = iIn.To, iIn.From, len(iData)
+      if iIn.Op == eOpGroupInvite {
+         aGroup := o.Group[iIn.Gid]
+         if aGroup == nil {
+            aGroup = &tRelayGroup{Member: map[string]string{iC.uid: iIn.From},
+                                  Invite: map[string]string{}}
+            o.Group[iIn.Gid] = aGroup
+         } else if aGroup.Member[iC.uid] == "" {
+            fAck("not a member of group "+ iIn.Gid)
+            break
+         }
+         aGroup.Invite[iIn.To] = aTo
+         aMsg["Op"], aMsg["Gid"] = "invite", iIn.Gid
+      }
+      fAck("")
+      aNodes := _nodesRelay(o.User[aTo], "")
+      aNodes = append(aNodes, _nodesRelay(o.User[iC.uid], iC.node)...)
+      o._post(aNodes, aMsg, iData)
+      o._save()
+   case eOpGroupEdit:
+      aGroup := o.Group[iIn.Gid]
+      if aGroup == nil {
+         fAck("group not found: "+ iIn.Gid)
+         break
+      }
+      if iIn.Act != "join" {
+         fAck("unsupported act: "+ iIn.Act)
+         break
+      }
+      aAlias := ""
+      for aK, aV := range aGroup.Invite {
+         if aV == iC.uid { aAlias = aK; break }
+      }
+      if aAlias == "" {
+         fAck("not invited to group "+ iIn.Gid)
+         break
+      }
+      delete(aGroup.Invite, aAlias)
+      aGroup.Member[iC.uid] = aAlias
+      fAck("")
+      aMsg := fMsg("member")
+      aMsg["Act"], aMsg["Gid"], aMsg["Alias"] = "join", iIn.Gid, aAlias
+      var aNodes []*tRelayNode
+      for aUid := range aGroup.Member {
+         aNodes = append(aNodes, _nodesRelay(o.User[aUid], "")...)
+      }
+      o._post(aNodes, aMsg, nil)
+      o._save()
+   case eOpPost, eOpPostNotify:
+      aNodes, aErr := o._forNodes(iC, iIn.For)
+      if aErr != "" {
+         fAck(aErr)
+         break
+      }
+      var aNoteNodes []*tRelayNode
+      aNoteNodes, aErr = o._forNodes(iC, iIn.NoteFor)
+      if aErr != "" {
+         fAck(aErr)
+         break
+      }
+      if !iIn.ForNotSelf {
+         aNodes = append(aNodes, _nodesRelay(o.User[iC.uid], iC.node)...)
+      }
+      fAck("")
+      aMsg := fMsg("delivery")
+      aMsg["DataHead"], aMsg["DataLen"] = iIn.DataHead, len(iData) - int(iIn.NoteLen)
+      if iIn.Op == eOpPostNotify {
+         aMsg["Notify"] = 1 // flags a forwarded thread
+      }
+      o._post(aNodes, aMsg, iData[iIn.NoteLen:])
+      if iIn.Op == eOpPostNotify { // after delivery, as recipients of the thread also get the note
+         aNote := fMsg("notify")
+         aNote["DataHead"], aNote["DataLen"] = iIn.NoteHead, iIn.NoteLen
+         o._post(append(aNoteNodes, aNodes...), aNote, iData[:iIn.NoteLen])
+      }
+      o._save()
+   case eOpAck:
+      aNode := o.User[iC.uid].Node[iC.node]
+      for a := range aNode.Queue {
+         if aNode.Queue[a].Head["Id"] == iIn.Id {
+            aNode.Queue = append(aNode.Queue[:a], aNode.Queue[a+1:]...)
+            o._save()
+            break
+         }
+      }
+   case eOpPulse:
+   case eOpQuit:
+      return false
+   default:
+      iC.send(packMsg(tMsg{"Op":"quit", "Error":fmt.Sprintf("unknown op %d", iIn.Op)}, nil))
+      return false
+   }
+   return true
+}
+
+// call with lock held
+func (o *tRelay) _login(iC *tRelayConn) {
+   if aPrior := o.conns[iC.node]; aPrior != nil {
+      aPrior.conn.Close()
+   }
+   aWasOnline := o._isOnline(iC.uid)
+   o.conns[iC.node] = iC
+   aOhi := []string{}
+   for aUid, aSet := range o.Ohi {
+      if aSet[iC.uid] && o._isOnline(aUid) {
+         aOhi = append(aOhi, aUid)
+      }
+   }
+   iC.send(packMsg(tMsg{"Op":"info", "Info":"login ok", "Ohi":aOhi}, nil))
+   for _, aM := range o.User[iC.uid].Node[iC.node].Queue {
+      iC.send(packMsg(aM.Head, aM.Data))
+   }
+   if !aWasOnline {
+      o._notifyOhi(iC.uid, 1)
+   }
+}
+
+// call with lock held
+func (o *tRelay) _post(iNodes []*tRelayNode, iHead tMsg, iData []byte) {
+   aDone := map[*tRelayNode]bool{}
+   for _, aNode := range iNodes {
+      if aDone[aNode] { continue }
+      aDone[aNode] = true
+      aNode.Queue = append(aNode.Queue, &tRelayMsg{Head: iHead, Data: iData})
+   }
+   for _, aC := range o.conns {
+      if aDone[o.User[aC.uid].Node[aC.node]] {
+         aC.send(packMsg(iHead, iData))
+      }
+   }
+}
+
+// call with lock held
+func (o *tRelay) _forNodes(iC *tRelayConn, iFor []tRelayFor) ([]*tRelayNode, string) {
+   var aNodes []*tRelayNode
+   for _, aF := range iFor {
+      switch aF.Type {
+      case eRelayForUser:
+         if o.User[aF.Id] == nil {
+            return nil, "uid not found: "+ aF.Id
+         }
+         aNodes = append(aNodes, _nodesRelay(o.User[aF.Id], "")...)
+      case eRelayForGroupAll, eRelayForGroupExcl:
+         aGroup := o.Group[aF.Id]
+         if aGroup == nil || aGroup.Member[iC.uid] == "" {
+            return nil, "not a member of group "+ aF.Id
+         }
+         for aUid := range aGroup.Member {
+            if aUid == iC.uid && aF.Type == eRelayForGroupExcl { continue }
+            aNodes = append(aNodes, _nodesRelay(o.User[aUid], iC.node)...)
+         }
+      case eRelayForSelf:
+         aNodes = append(aNodes, _nodesRelay(o.User[iC.uid], iC.node)...)
+      default:
+         return nil, fmt.Sprintf("invalid for.type %d", aF.Type)
+      }
+   }
+   return aNodes, ""
+}
+
+// call with lock held
+func (o *tRelay) _isOnline(iUid string) bool {
+   for _, aC := range o.conns {
+      if aC.uid == iUid { return true }
+   }
+   return false
+}
+
+// call with lock held
+func (o *tRelay) _notifyOhi(iUid string, iStatus int) {
+   for aTo := range o.Ohi[iUid] {
+      o._sendOhi(iUid, aTo, iStatus)
+   }
+}
+
+// call with lock held
+func (o *tRelay) _sendOhi(iFrom, iTo string, iStatus int) {
+   if !o._isOnline(iFrom) {
+      return
+   }
+   for _, aC := range o.conns {
+      if aC.uid == iTo {
+         aC.send(packMsg(tMsg{"Op":"ohi", "From":iFrom, "Status":iStatus}, nil))
+      }
+   }
+}
+
+func _nodesRelay(iUser *tRelayUser, iExclude string) []*tRelayNode {
+   aList := make([]*tRelayNode, 0, len(iUser.Node))
+   for aK, aV := range iUser.Node {
+      if aK != iExclude {
+         aList = append(aList, aV)
+      }
+   }
+   return aList
+}
+
+// call with lock held
+func (o *tRelay) _makeMsgId() string {
+   aId := uint64(time.Now().UnixNano())
+   if aId <= o.LastMsgId {
+      aId = o.LastMsgId + 1
+   }
+   o.LastMsgId = aId
+   return fmt.Sprintf("%016x", aId)
+}
+
+func _makeIdRelay(iLen int) string {
+   aBuf := make([]byte, iLen)
+   _, err := rand.Read(aBuf)
+   if err != nil { quit(err) }
+   return hex.EncodeToString(aBuf)
+}
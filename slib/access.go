@@ -0,0 +1,193 @@
+// Copyright 2017, 2019 Liam Breck
+// Published at https://github.com/networkimprov/mnm-hammer
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/
+
+package slib
+
+import (
+   "crypto/ecdsa"
+   "crypto/elliptic"
+   "crypto/hmac"
+   "crypto/rand"
+   "crypto/sha256"
+   "crypto/subtle"
+   "crypto/x509"
+   "crypto/x509/pkix"
+   "encoding/hex"
+   "encoding/pem"
+   "fmt"
+   "math/big"
+   "net"
+   "os"
+   "strconv"
+   "strings"
+   "sync"
+   "time"
+)
+
+const kAccessHashRounds = 1 << 16
+const kAccessSessionPeriod = 30 * 24 * time.Hour
+
+func fileAccess() string { return sStorageDir + "access" }
+func fileCert  () string { return sStorageDir + "tls-cert.pem" }
+func fileCertKey() string { return sStorageDir + "tls-key.pem" }
+
+type tAccess struct {
+   Salt, Hash string // hex; empty if access is open
+   Key string // hex; signs session cookies
+}
+
+var sAccess tAccess
+var sAccessDoor sync.RWMutex
+
+func initAccess() {
+   err := resolveTmpFile(fileAccess() + ".tmp")
+   if err != nil { quit(err) }
+   err = readJsonFile(&sAccess, fileAccess())
+   if err != nil && !os.IsNotExist(err) { quit(err) }
+}
+
+func IsOnAccess() bool {
+   sAccessDoor.RLock(); defer sAccessDoor.RUnlock()
+   return sAccess.Hash != ""
+}
+
+// replaces the secret and invalidates existing sessions; generates a token if iSecret is empty
+func SetSecretAccess(iSecret string) (string, error) {
+   if iSecret == "" {
+      iSecret = hex.EncodeToString(_randAccess(16))
+   }
+   aSalt := _randAccess(16)
+   aNew := tAccess{Salt: hex.EncodeToString(aSalt),
+                   Hash: hex.EncodeToString(_hashAccess(aSalt, iSecret)),
+                   Key:  hex.EncodeToString(_randAccess(32))}
+   err := os.MkdirAll(sStorageDir, 0700)
+   if err != nil { return "", err }
+   _, err = os.Stat(fileAccess())
+   if err == nil {
+      err = storeFile(fileAccess(), &aNew)
+   } else if os.IsNotExist(err) {
+      err = writeJsonFile(fileAccess() + ".tmp", &aNew)
+      if err == nil {
+         err = resolveTmpFile(fileAccess() + ".tmp")
+      }
+      if err == nil {
+         err = syncDir(sStorageDir)
+      }
+   }
+   if err != nil { return "", err }
+   sAccessDoor.Lock(); defer sAccessDoor.Unlock()
+   sAccess = aNew
+   return iSecret, nil
+}
+
+// returns a session value for a cookie, or "" if iSecret is wrong
+func LoginAccess(iSecret string) string {
+   sAccessDoor.RLock(); defer sAccessDoor.RUnlock()
+   if sAccess.Hash == "" {
+      return ""
+   }
+   aSalt, err := hex.DecodeString(sAccess.Salt)
+   if err != nil { quit(err) }
+   aHash, err := hex.DecodeString(sAccess.Hash)
+   if err != nil { quit(err) }
+   if subtle.ConstantTimeCompare(_hashAccess(aSalt, iSecret), aHash) != 1 {
+      return ""
+   }
+   aExpires := fmt.Sprint(time.Now().Add(kAccessSessionPeriod).Unix())
+   return aExpires +"."+ _signAccess(aExpires)
+}
+
+func CheckSessionAccess(iSession string) bool {
+   sAccessDoor.RLock(); defer sAccessDoor.RUnlock()
+   aPair := strings.SplitN(iSession, ".", 2)
+   if len(aPair) != 2 {
+      return false
+   }
+   aExpires, err := strconv.ParseInt(aPair[0], 10, 64)
+   if err != nil || time.Now().Unix() > aExpires {
+      return false
+   }
+   return hmac.Equal([]byte(_signAccess(aPair[0])), []byte(aPair[1]))
+}
+
+func _signAccess(iExpires string) string {
+   aKey, err := hex.DecodeString(sAccess.Key)
+   if err != nil { quit(err) }
+   aMac := hmac.New(sha256.New, aKey)
+   aMac.Write([]byte(iExpires))
+   return hex.EncodeToString(aMac.Sum(nil))
+}
+
+//todo use scrypt or argon2 if golang.org/x/crypto becomes a dependency
+func _hashAccess(iSalt []byte, iSecret string) []byte {
+   aSum := sha256.Sum256(append(append([]byte{}, iSalt...), iSecret...))
+   for a := 0; a < kAccessHashRounds; a++ {
+      aSum = sha256.Sum256(append(aSum[:], iSalt...))
+   }
+   return aSum[:]
+}
+
+func _randAccess(iLen int) []byte {
+   aBuf := make([]byte, iLen)
+   _, err := rand.Read(aBuf)
+   if err != nil { quit(err) }
+   return aBuf
+}
+
+// returns paths of a self-signed certificate & key for the http server, creating them if needed
+func GetCertAccess(iHosts []string) (string, string, error) {
+   _, err := os.Stat(fileCert())
+   if err == nil {
+      return fileCert(), fileCertKey(), nil
+   } else if !os.IsNotExist(err) {
+      return "", "", err
+   }
+   aKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+   if err != nil { return "", "", err }
+   aSerial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+   if err != nil { return "", "", err }
+   aTmpl := x509.Certificate{
+      SerialNumber: aSerial,
+      Subject: pkix.Name{Organization: []string{"mnm-hammer"}},
+      NotBefore: time.Now().Add(-time.Hour),
+      NotAfter: time.Now().AddDate(10, 0, 0),
+      KeyUsage: x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+      ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+      BasicConstraintsValid: true,
+      IsCA: true,
+   }
+   for _, aHost := range iHosts {
+      if aIp := net.ParseIP(aHost); aIp != nil {
+         aTmpl.IPAddresses = append(aTmpl.IPAddresses, aIp)
+      } else if aHost != "" {
+         aTmpl.DNSNames = append(aTmpl.DNSNames, aHost)
+      }
+   }
+   aCert, err := x509.CreateCertificate(rand.Reader, &aTmpl, &aTmpl, &aKey.PublicKey, aKey)
+   if err != nil { return "", "", err }
+   aKeyDer, err := x509.MarshalECPrivateKey(aKey)
+   if err != nil { return "", "", err }
+   err = os.MkdirAll(sStorageDir, 0700)
+   if err != nil { return "", "", err }
+   // write key first; cert presence indicates a complete pair
+   for _, aF := range [...]struct{ path, kind string; der []byte }{
+         {fileCertKey(), "EC PRIVATE KEY", aKeyDer}, {fileCert(), "CERTIFICATE", aCert}} {
+      aFd, err := os.OpenFile(aF.path +".tmp", os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+      if err != nil { return "", "", err }
+      err = pem.Encode(aFd, &pem.Block{Type: aF.kind, Bytes: aF.der})
+      if err == nil {
+         err = aFd.Sync()
+      }
+      aFd.Close()
+      if err != nil { return "", "", err }
+      err = os.Rename(aF.path +".tmp", aF.path)
+      if err != nil { return "", "", err }
+   }
+   err = syncDir(sStorageDir)
+   if err != nil { return "", "", err }
+   return fileCert(), fileCertKey(), nil
+}
@@ -507,6 +507,11 @@ func _completeAdrsbk(iSvc string, iTmp string, iEls []tAdrsbkEl) {
    defer aFd.Close()
    aPos, err := strconv.ParseInt(aRec[1], 10, 64)
    if err != nil { quit(err) }
+   aFi, err := aFd.Stat()
+   if err != nil { quit(err) }
+   if aPos > aFi.Size() { // file was quarantined
+      aPos = 2
+   }
    if aPos != 2 {
       _, err = aFd.Seek(aPos-1, io.SeekStart)
       if err != nil { quit(err) }
@@ -553,6 +558,8 @@ func GetDraftAdrsbk(iSvc string) interface{} {
       tAdrsbkEl
       Text string // hides tAdrsbkEl.Text
       Queued bool `json:",omitempty"`
+      Failed string `json:",omitempty"`
+      Due string `json:",omitempty"`
    }
    var aMap map[string]*tAdrsbkElOut
    aDoor := &getService(iSvc).adrsbk.draftDoor
@@ -566,6 +573,11 @@ func GetDraftAdrsbk(iSvc string) interface{} {
    aList := make([]*tAdrsbkElOut, 0, len(aMap))
    for _, aEl := range aMap {
       aEl.Queued = hasQueue(iSvc, eSrecPing, aEl.Qid)
+      if aEl.Queued {
+         aEl.Failed = failedQueue(iSvc, eSrecPing, aEl.Qid)
+      } else {
+         aEl.Due = dueQueue(iSvc, eSrecPing, aEl.Qid)
+      }
       aList = append(aList, aEl)
    }
    sort.Slice(aList, func(cA, cB int) bool {
@@ -630,9 +642,13 @@ func storeDraftAdrsbk(iSvc string, iUpdt *Update) {
    err = readJsonFile(&aMap, filePing(iSvc))
    if err != nil && !os.IsNotExist(err) { quit(err) }
    aKey := iUpdt.Ping.To + "\x00" + iUpdt.Ping.Gid
+   aQid := makeLocalId(aKey)
+   if aPrev := aMap[aKey]; aPrev != nil && dueQueue(iSvc, eSrecPing, aPrev.Qid) != "" {
+      aQid = aPrev.Qid // keep scheduled send
+   }
    aMap[aKey] = &tAdrsbkEl{Type:eAbPingDraft, Date:dateRFC3339(), Text:iUpdt.Ping.Text,
                            Alias:iUpdt.Ping.To, MyAlias:iUpdt.Ping.Alias, Gid:iUpdt.Ping.Gid,
-                           Qid:makeLocalId(aKey)}
+                           Qid:aQid}
    err = storeFile(filePing(iSvc), aMap)
    if err != nil { quit(err) }
 }
@@ -413,7 +413,7 @@ func updateDraftAttach(iSvc string, iSubHeadOld, iSubHeadNew *tHeader2, iRec tCo
       }
       for _, aFile := range iSubHeadNew.Attach {
          if _isFormFill(aFile.Name) { continue }
-         aPath := kFormDir + aFile.Name[2:]
+         aPath := sFormDir + aFile.Name[2:]
          if !_isForm(aFile.Name) {
             aPath = fileUpload(aFile.Name[2:])
          }
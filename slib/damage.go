@@ -0,0 +1,176 @@
+// Copyright 2017, 2019 Liam Breck
+// Published at https://github.com/networkimprov/mnm-hammer
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/
+
+package slib
+
+import (
+   "fmt"
+   "os"
+   "path"
+   "sort"
+   "strings"
+   "sync"
+   "time"
+)
+
+var sDamageDoor sync.Mutex
+var sDamage = make(map[string]map[string]*tDamageEl) // key service, object
+
+type tDamageEl struct {
+   Object, Error string
+   Moved bool `json:",omitempty"` // already in quarantine
+}
+
+type tDamage struct {
+   path string
+   err error
+}
+
+// aborts the current operation on a damaged file; caught by RecoverDamage()
+func damage(iPath string, err error) {
+   panic(&tDamage{path: iPath, err: err})
+}
+
+// call from a deferred func as RecoverDamage(svc, recover())
+// returns nil if iPanic is nil, re-panics if not from damage()
+func RecoverDamage(iSvc string, iPanic interface{}) error {
+   if iPanic == nil {
+      return nil
+   }
+   aDmg, ok := iPanic.(*tDamage)
+   if !ok {
+      panic(iPanic)
+   }
+   aObj := _objectDamage(iSvc, aDmg.path)
+   _addDamage(iSvc, aObj, aDmg.err.Error(), false)
+   return tError("damaged "+ aObj +": "+ aDmg.err.Error())
+}
+
+func GetIdxDamage(iSvc string) interface{} {
+   sDamageDoor.Lock(); defer sDamageDoor.Unlock()
+   aList := make([]tDamageEl, 0, len(sDamage[iSvc]))
+   for _, aV := range sDamage[iSvc] {
+      aList = append(aList, *aV)
+   }
+   sort.Slice(aList, func(cA, cB int) bool { return aList[cA].Object < aList[cB].Object })
+   return aList
+}
+
+func listDamage(iSvc string) []string {
+   sDamageDoor.Lock(); defer sDamageDoor.Unlock()
+   aList := make([]string, 0, len(sDamage[iSvc]))
+   for aK := range sDamage[iSvc] {
+      aList = append(aList, aK)
+   }
+   sort.Strings(aList)
+   return aList
+}
+
+// moves a damaged file to quarantine, so the service can run without its contents
+func quarantineDamage(iSvc string, iPath string, err error) {
+   aObj := _objectDamage(iSvc, iPath)
+   aErr := _moveDamage(iSvc, aObj, iPath)
+   if aErr != nil { quit(aErr) }
+   _addDamage(iSvc, aObj, err.Error(), true)
+}
+
+// moves thread iTid and its attachments to quarantine if iPanic is from damage()
+// call from a deferred func as quarantineThreadDamage(svc, tid, recover())
+func quarantineThreadDamage(iSvc string, iTid string, iPanic interface{}) {
+   if iPanic == nil {
+      return
+   }
+   aDmg, ok := iPanic.(*tDamage)
+   if !ok {
+      panic(iPanic)
+   }
+   quarantineDamage(iSvc, dirThread(iSvc) + iTid, aDmg.err)
+   err := os.Rename(dirAttach(iSvc) + iTid, _pathDamage(iSvc, iTid + "_attach")) // as FsckService()
+   if err != nil && !os.IsNotExist(err) { quit(err) }
+}
+
+// moves a damaged thread or form table to quarantine, and forgets the damage record
+func discardDamage(iSvc string, iObj string) error {
+   sDamageDoor.Lock()
+   aEl := sDamage[iSvc][iObj]
+   sDamageDoor.Unlock()
+   if aEl == nil {
+      return tError("no damaged object "+ iObj)
+   }
+   if !aEl.Moved {
+      var err error
+      if strings.HasPrefix(iObj, "thread/") {
+         err = _discardThreadDamage(iSvc, iObj)
+      } else if strings.HasPrefix(iObj, "form/") {
+         aDoor := _getFormDoor(iSvc, unescapeFile(iObj[5:]))
+         aDoor.Lock()
+         err = _moveDamage(iSvc, iObj, dirSvc(iSvc) + iObj)
+         aDoor.Unlock()
+      } else {
+         return tError("cannot discard "+ iObj)
+      }
+      if err != nil && !os.IsNotExist(err) { quit(err) }
+   }
+   sDamageDoor.Lock()
+   delete(sDamage[iSvc], iObj)
+   sDamageDoor.Unlock()
+   return nil
+}
+
+func _discardThreadDamage(iSvc string, iObj string) error {
+   aFn := iObj[7:]
+   aTid, aDoorId := aFn, aFn
+   if !strings.HasSuffix(aFn, "_forward") && strings.ContainsRune(aFn[1:], '_') { // draft of reply
+      aTid = parseLocalId(aFn).tid()
+      aDoorId = aTid
+   }
+   aDoor := _getThreadDoor(iSvc, aDoorId)
+   aDoor.Lock(); defer aDoor.Unlock()
+   err := _moveDamage(iSvc, iObj, dirThread(iSvc) + aFn)
+   if err != nil || aFn != aTid {
+      return err
+   }
+   err = os.Rename(dirAttach(iSvc) + aTid, _pathDamage(iSvc, aTid + "_attach")) // as FsckService()
+   if err != nil && !os.IsNotExist(err) { return err }
+   deleteThreadSearch(iSvc, aTid)
+   return nil
+}
+
+func _moveDamage(iSvc string, iObj string, iPath string) error {
+   err := os.MkdirAll(dirQuarantine(iSvc), 0700)
+   if err != nil { return err }
+   aName := strings.ReplaceAll(strings.TrimPrefix(iObj, "thread/"), "/", "_")
+   err = os.Rename(iPath, _pathDamage(iSvc, aName))
+   if err != nil { return err }
+   fmt.Fprintf(os.Stderr, "damage %s: %s moved to %s\n", iSvc, iObj, dirQuarantine(iSvc))
+   return syncDir(path.Dir(iPath))
+}
+
+// returns quarantine path for iName, avoiding a prior copy
+func _pathDamage(iSvc string, iName string) string {
+   _, err := os.Lstat(dirQuarantine(iSvc) + iName)
+   if err == nil {
+      iName += "." + fmt.Sprint(time.Now().UTC().UnixNano())
+   }
+   return dirQuarantine(iSvc) + iName
+}
+
+func _addDamage(iSvc string, iObj string, iErr string, iMoved bool) {
+   fmt.Fprintf(os.Stderr, "damage %s: %s: %s\n", iSvc, iObj, iErr)
+   sDamageDoor.Lock(); defer sDamageDoor.Unlock()
+   if sDamage[iSvc] == nil {
+      sDamage[iSvc] = make(map[string]*tDamageEl)
+   }
+   sDamage[iSvc][iObj] = &tDamageEl{Object:iObj, Error:iErr, Moved:iMoved}
+}
+
+func _objectDamage(iSvc string, iPath string) string {
+   if strings.HasPrefix(iPath, sStateDir) {
+      return "state/"+ path.Dir(iPath[len(sStateDir):])
+   }
+   return strings.TrimPrefix(iPath, dirSvc(iSvc))
+}
@@ -0,0 +1,622 @@
+// Copyright 2017, 2019 Liam Breck
+// Published at https://github.com/networkimprov/mnm-hammer
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/
+
+package slib
+
+import (
+   "archive/zip"
+   "bytes"
+   "encoding/base64"
+   "encoding/csv"
+   "encoding/json"
+   "encoding/xml"
+   "fmt"
+   "html/template"
+   "io"
+   "mime"
+   "mime/multipart"
+   "mime/quotedprintable"
+   "net/mail"
+   "net/textproto"
+   "os"
+   "path"
+   "sort"
+   "strings"
+   "time"
+
+   "github.com/russross/blackfriday/v2"
+)
+
+const kExportDomain = "mnm.invalid" // for addresses & message-ids; tmtp has no email domain
+
+const (
+   eExportMbox = "mbox" // mboxrd, one message per stored message
+   eExportEml  = "eml"  // one message
+   eExportHtml = "html" // self-contained page
+   eExportCsv  = "csv"  // form table, one row per filled form
+   eExportXlsx = "xlsx" // form table as spreadsheet
+)
+
+const kExportCellMax = 32767 // xlsx limit
+
+type tExport struct {
+   svc, tid string
+   uid string
+   subject string // of thread
+}
+
+// writes the open thread of iState; iMsgId selects a message for eml
+func WriteThreadExport(iW io.Writer, iSvc string, iState *ClientState, iFormat string, iMsgId string) error {
+   aTid := iState.getThread()
+   if aTid == "" || aTid[0] == '_' {
+      return tError("no thread to export")
+   }
+   return _writeExport(iW, iSvc, aTid, iFormat, iMsgId)
+}
+
+// writes thread iTid of service iSvc; runs without Init()
+func ExportService(iW io.Writer, iSvc string, iFormat string, iTid, iMsgId string) (err error) {
+   defer func() {
+      if aDmgErr := RecoverDamage(iSvc, recover()); aDmgErr != nil {
+         err = aDmgErr
+      }
+   }()
+   aSvc := _newService(nil) // no search index
+   err = readJsonFile(&aSvc.config, fileCfg(iSvc))
+   if err != nil { return err }
+   sServicesDoor.Lock()
+   sServices[iSvc] = aSvc
+   sServicesDoor.Unlock()
+   if iTid == "" || iTid[0] == '_' || strings.ContainsAny(iTid, "/\\") {
+      return tError("invalid thread id")
+   }
+   return _writeExport(iW, iSvc, iTid, iFormat, iMsgId)
+}
+
+func _writeExport(iW io.Writer, iSvc string, iTid string, iFormat string, iMsgId string) error {
+   aEx := &tExport{svc: iSvc, tid: iTid, uid: GetConfigService(iSvc).Uid}
+   switch iFormat {
+   case eExportMbox:
+      return aEx.walk("", func(cHead *tMsgHead, cBody []byte) error {
+         cMsg, err := aEx.message(cHead, cBody)
+         if err != nil { return err }
+         cDate, _ := time.Parse(time.RFC3339, cHead.Posted)
+         _, err = fmt.Fprintf(iW, "From %s %s\n", _uidAddressExport(cHead.From),
+                                  cDate.UTC().Format(time.ANSIC))
+         if err != nil { return err }
+         cMsg = bytes.ReplaceAll(cMsg, []byte("\r\n"), []byte{'\n'})
+         _, err = iW.Write(append(_escapeMboxExport(cMsg), '\n'))
+         return err
+      })
+   case eExportEml:
+      if iMsgId == "" { iMsgId = iTid }
+      return aEx.walk(iMsgId, func(cHead *tMsgHead, cBody []byte) error {
+         cMsg, err := aEx.message(cHead, cBody)
+         if err != nil { return err }
+         _, err = iW.Write(cMsg)
+         return err
+      })
+   case eExportHtml:
+      return aEx.html(iW)
+   }
+   return tError("unknown export format "+ iFormat)
+}
+
+// writes filled-form table iFft with nested fields flattened into columns, ordered per the form spec
+func WriteFormExport(iW io.Writer, iSvc string, iFormat string, iFft string) error {
+   if iFormat != eExportCsv && iFormat != eExportXlsx {
+      return tError("unknown export format "+ iFormat)
+   }
+   aFlat, aCols, err := flattenTableExport(iSvc, iFft)
+   if err != nil { return err }
+
+   aTable := make([][]interface{}, 1+len(aFlat))
+   aTable[0] = make([]interface{}, len(aCols))
+   for a, aCol := range aCols {
+      aTable[0][a] = aCol
+   }
+   for a, aRow := range aFlat {
+      aTable[a+1] = make([]interface{}, len(aCols))
+      for a1, aCol := range aCols {
+         aTable[a+1][a1] = aRow[aCol]
+      }
+   }
+   if iFormat == eExportCsv {
+      return _writeCsvExport(iW, aTable)
+   }
+   return _writeXlsxExport(iW, aTable)
+}
+
+// returns the rows of filled-form table iFft as maps of column to scalar value, with
+// $msgid, $alias, $date, and $text (unparsed form data); also returns the column list
+func flattenTableExport(iSvc string, iFft string) ([]map[string]interface{}, []string, error) {
+   aFfn := strings.TrimSuffix(iFft, kSuffixRecv)
+   if aFfn == iFft {
+      aFfn = strings.TrimSuffix(iFft, kSuffixSent)
+   }
+   if aFfn == iFft {
+      return nil, nil, tError("invalid form table name")
+   }
+   aRows, err := readTableFilledForm(iSvc, iFft)
+   if err != nil { return nil, nil, err }
+
+   aCols := []string{"$msgid", "$alias", "$date"}
+   aColPos := make(map[string]int) // position of first appearance
+   aFlat := make([]map[string]interface{}, len(aRows))
+   aIdx := make(map[string][]tIndexElCore) // by threadid
+   for a, aRow := range aRows {
+      aFlat[a] = make(map[string]interface{}, len(aRow))
+      for _, aKey := range _sortedKeysExport(aRow) {
+         if aKey[0] != '$' {
+            _flattenExport(aFlat[a], aColPos, aKey, aRow[aKey])
+         }
+      }
+      aTid, _ := aRow["$threadid"].(string)
+      aMid, _ := aRow["$msgid"].(string)
+      if _, ok := aIdx[aTid]; !ok && aTid != "" {
+         aIdx[aTid] = getIndexThread(iSvc, aTid)
+      }
+      for _, aEl := range aIdx[aTid] {
+         if aEl.Id == aMid {
+            aFlat[a]["$alias"], aFlat[a]["$date"] = aEl.Alias, aEl.Date
+            break
+         }
+      }
+      aFlat[a]["$msgid"] = aMid
+      if aRow["$text"] != nil { // form data that could not be parsed
+         aFlat[a]["$text"] = aRow["$text"]
+      }
+   }
+   aSpecPos := make(map[string]int)
+   _specPosExport(aSpecPos, "", getSpecFilledForm(iSvc, aFfn))
+   fRank := func(cCol string) int {
+      if cPos, ok := aSpecPos[_basePathExport(cCol)]; ok {
+         return cPos
+      }
+      return len(aSpecPos)
+   }
+   aData := make([]string, 0, len(aColPos))
+   for aK := range aColPos {
+      aData = append(aData, aK)
+   }
+   sort.Slice(aData, func(cA, cB int) bool {
+      if cRa, cRb := fRank(aData[cA]), fRank(aData[cB]); cRa != cRb { return cRa < cRb }
+      return aColPos[aData[cA]] < aColPos[aData[cB]]
+   })
+   aCols = append(aCols, aData...)
+   for _, aRow := range aFlat {
+      if aRow["$text"] != nil {
+         aCols = append(aCols, "$text")
+         break
+      }
+   }
+   return aFlat, aCols, nil
+}
+
+func _sortedKeysExport(iMap map[string]interface{}) []string {
+   aKeys := make([]string, 0, len(iMap))
+   for aK := range iMap {
+      aKeys = append(aKeys, aK)
+   }
+   sort.Strings(aKeys)
+   return aKeys
+}
+
+// sets a column in ioRow for each scalar in iV, named like "or.anr[1][0]";
+// ioPos records the order in which columns first appear
+func _flattenExport(ioRow map[string]interface{}, ioPos map[string]int, iPath string, iV interface{}) {
+   switch aV := iV.(type) {
+   case map[string]interface{}:
+      for _, aK := range _sortedKeysExport(aV) {
+         _flattenExport(ioRow, ioPos, iPath +"."+ aK, aV[aK])
+      }
+   case []interface{}:
+      for a := range aV {
+         _flattenExport(ioRow, ioPos, fmt.Sprintf("%s[%d]", iPath, a), aV[a])
+      }
+   default:
+      ioRow[iPath] = iV
+      if _, ok := ioPos[iPath]; !ok {
+         ioPos[iPath] = len(ioPos)
+      }
+   }
+}
+
+// returns a column name without array indexes, e.g. "or.anr"
+func _basePathExport(iCol string) string {
+   aBuf := make([]byte, 0, len(iCol))
+   for a := 0; a < len(iCol); a++ {
+      if iCol[a] == '[' {
+         for a < len(iCol) && iCol[a] != ']' { a++ }
+         continue
+      }
+      aBuf = append(aBuf, iCol[a])
+   }
+   return string(aBuf)
+}
+
+func _specPosExport(ioPos map[string]int, iParent string, iSpec []tSpecEl) {
+   for _, aEl := range iSpec {
+      ioPos[iParent + aEl.Name] = len(ioPos)
+      if aEl.Type == "object" {
+         _specPosExport(ioPos, iParent + aEl.Name +".", aEl.Spec)
+      }
+   }
+}
+
+func _writeCsvExport(iW io.Writer, iTable [][]interface{}) error {
+   aW := csv.NewWriter(iW)
+   aRec := make([]string, len(iTable[0]))
+   for _, aRow := range iTable {
+      for a, aV := range aRow {
+         switch aT := aV.(type) {
+         case nil:
+            aRec[a] = ""
+         case string:
+            if aT != "" && strings.IndexByte("=+-@\t\r", aT[0]) >= 0 {
+               aT = "'"+ aT // not a formula
+            }
+            aRec[a] = aT
+         default:
+            aRec[a] = fmt.Sprint(aT)
+         }
+      }
+      err := aW.Write(aRec)
+      if err != nil { return err }
+   }
+   aW.Flush()
+   return aW.Error()
+}
+
+const kXlsxTypes = `<?xml version="1.0" encoding="UTF-8" standalone="yes"?>
+<Types xmlns="http://schemas.openxmlformats.org/package/2006/content-types">` +
+`<Default Extension="rels" ContentType="application/vnd.openxmlformats-package.relationships+xml"/>` +
+`<Default Extension="xml" ContentType="application/xml"/>` +
+`<Override PartName="/xl/workbook.xml" ` +
+   `ContentType="application/vnd.openxmlformats-officedocument.spreadsheetml.sheet.main+xml"/>` +
+`<Override PartName="/xl/worksheets/sheet1.xml" ` +
+   `ContentType="application/vnd.openxmlformats-officedocument.spreadsheetml.worksheet+xml"/></Types>`
+const kXlsxRels = `<?xml version="1.0" encoding="UTF-8" standalone="yes"?>
+<Relationships xmlns="http://schemas.openxmlformats.org/package/2006/relationships">` +
+`<Relationship Id="rId1" Target="xl/workbook.xml" ` +
+   `Type="http://schemas.openxmlformats.org/officeDocument/2006/relationships/officeDocument"/>` +
+`</Relationships>`
+const kXlsxBook = `<?xml version="1.0" encoding="UTF-8" standalone="yes"?>
+<workbook xmlns="http://schemas.openxmlformats.org/spreadsheetml/2006/main" ` +
+   `xmlns:r="http://schemas.openxmlformats.org/officeDocument/2006/relationships">` +
+`<sheets><sheet name="Table" sheetId="1" r:id="rId1"/></sheets></workbook>`
+const kXlsxBookRels = `<?xml version="1.0" encoding="UTF-8" standalone="yes"?>
+<Relationships xmlns="http://schemas.openxmlformats.org/package/2006/relationships">` +
+`<Relationship Id="rId1" Target="worksheets/sheet1.xml" ` +
+   `Type="http://schemas.openxmlformats.org/officeDocument/2006/relationships/worksheet"/>` +
+`</Relationships>`
+
+// writes a minimal workbook with one sheet; strings are stored inline
+func _writeXlsxExport(iW io.Writer, iTable [][]interface{}) error {
+   aZw := zip.NewWriter(iW)
+   for _, aF := range [...]struct{ name, data string }{
+         {"[Content_Types].xml", kXlsxTypes}, {"_rels/.rels", kXlsxRels},
+         {"xl/workbook.xml", kXlsxBook}, {"xl/_rels/workbook.xml.rels", kXlsxBookRels}} {
+      aFw, err := aZw.Create(aF.name)
+      if err != nil { return err }
+      _, err = io.WriteString(aFw, aF.data)
+      if err != nil { return err }
+   }
+   aFw, err := aZw.Create("xl/worksheets/sheet1.xml")
+   if err != nil { return err }
+   var aBuf bytes.Buffer
+   aBuf.WriteString(`<?xml version="1.0" encoding="UTF-8" standalone="yes"?>` +"\n"+
+      `<worksheet xmlns="http://schemas.openxmlformats.org/spreadsheetml/2006/main"><sheetData>`)
+   for a, aRow := range iTable {
+      fmt.Fprintf(&aBuf, `<row r="%d">`, a+1)
+      for a1, aV := range aRow {
+         aRef := _columnXlsxExport(a1) + fmt.Sprint(a+1)
+         switch aT := aV.(type) {
+         case nil:
+            continue
+         case json.Number:
+            fmt.Fprintf(&aBuf, `<c r="%s"><v>%s</v></c>`, aRef, aT)
+         case bool:
+            aB := 0; if aT { aB = 1 }
+            fmt.Fprintf(&aBuf, `<c r="%s" t="b"><v>%d</v></c>`, aRef, aB)
+         default:
+            aStr := fmt.Sprint(aT)
+            if len(aStr) > kExportCellMax { aStr = strings.ToValidUTF8(aStr[:kExportCellMax], "") }
+            fmt.Fprintf(&aBuf, `<c r="%s" t="inlineStr"><is><t xml:space="preserve">`, aRef)
+            xml.EscapeText(&aBuf, []byte(aStr))
+            aBuf.WriteString(`</t></is></c>`)
+         }
+      }
+      aBuf.WriteString(`</row>`)
+      _, err = aFw.Write(aBuf.Bytes())
+      if err != nil { return err }
+      aBuf.Reset()
+   }
+   _, err = io.WriteString(aFw, `</sheetData></worksheet>`)
+   if err != nil { return err }
+   return aZw.Close()
+}
+
+// returns the letters for zero-based column iN, e.g. 0 "A", 26 "AA"
+func _columnXlsxExport(iN int) string {
+   aCol := ""
+   for iN++; iN > 0; iN = (iN - 1) / 26 {
+      aCol = string(rune('A' + (iN - 1) % 26)) + aCol
+   }
+   return aCol
+}
+
+// calls iFn for each stored message, or only iMsgId if set; skips drafts
+func (o *tExport) walk(iMsgId string, iFn func(*tMsgHead, []byte) error) error {
+   aDoor := _getThreadDoor(o.svc, o.tid)
+   aDoor.RLock(); defer aDoor.RUnlock()
+   if aDoor.renamed { return tError("thread name changed") }
+
+   aFd, err := os.Open(dirThread(o.svc) + o.tid)
+   if err != nil {
+      if !os.IsNotExist(err) { quit(err) }
+      return tError("thread not found")
+   }
+   defer aFd.Close()
+   var aIdx []tIndexEl
+   _readIndex(aFd, &aIdx, nil)
+   if len(aIdx) > 0 {
+      o.subject = aIdx[0].Subject
+   }
+   aFound := false
+   for a := range aIdx {
+      if aIdx[a].Offset < 0 { continue } // draft
+      if iMsgId != "" && aIdx[a].Id != iMsgId { continue }
+      _, err = aFd.Seek(aIdx[a].Offset, io.SeekStart)
+      if err != nil { quit(err) }
+      aHead := _readMsgHead(aFd)
+      aBody := make([]byte, aHead.Size)
+      _, err = io.ReadFull(aFd, aBody)
+      if err != nil { damage(aFd.Name(), err) }
+      err = iFn(aHead, aBody)
+      if err != nil { return err }
+      aFound = true
+   }
+   if !aFound {
+      return tError("message not found")
+   }
+   return nil
+}
+
+// returns an RFC 5322 message with CRLF line endings
+func (o *tExport) message(iHead *tMsgHead, iBody []byte) ([]byte, error) {
+   var err error
+   var aBuf bytes.Buffer
+   aDate, _ := time.Parse(time.RFC3339, iHead.Posted)
+   aSubject := iHead.SubHead.Subject
+   if iHead.Id != o.tid {
+      if aSubject == "" { aSubject = o.subject }
+      aSubject = "Re: "+ aSubject
+   }
+   fmt.Fprintf(&aBuf, "From: %s\r\n", _addressExport(iHead.SubHead.Alias, iHead.From))
+   if len(iHead.SubHead.Cc) > 0 {
+      aTo := make([]string, len(iHead.SubHead.Cc))
+      for a, aCc := range iHead.SubHead.Cc {
+         aName := aCc.Who; if aName == aCc.WhoUid { aName = "" } // group
+         aTo[a] = _addressExport(aName, aCc.WhoUid)
+      }
+      fmt.Fprintf(&aBuf, "To: %s\r\n", strings.Join(aTo, ",\r\n "))
+   }
+   fmt.Fprintf(&aBuf, "Date: %s\r\n", aDate.Format(time.RFC1123Z))
+   fmt.Fprintf(&aBuf, "Subject: %s\r\n", mime.QEncoding.Encode("utf-8", aSubject))
+   fmt.Fprintf(&aBuf, "Message-ID: <%s@%s>\r\n", iHead.Id, kExportDomain)
+   if iHead.Id != o.tid {
+      fmt.Fprintf(&aBuf, "In-Reply-To: <%s@%s>\r\n", o.tid, kExportDomain)
+      fmt.Fprintf(&aBuf, "References: <%s@%s>\r\n", o.tid, kExportDomain)
+   }
+   fmt.Fprintf(&aBuf, "X-Mnm-Service: %s\r\n", mime.QEncoding.Encode("utf-8", o.svc))
+   fmt.Fprintf(&aBuf, "MIME-Version: 1.0\r\n")
+
+   if len(iHead.SubHead.Attach) == 0 {
+      fmt.Fprintf(&aBuf, "Content-Type: text/plain; charset=utf-8\r\n"+
+                         "Content-Transfer-Encoding: quoted-printable\r\n\r\n")
+      err = _writeQpExport(&aBuf, iBody)
+      return aBuf.Bytes(), err
+   }
+   aMw := multipart.NewWriter(&aBuf)
+   fmt.Fprintf(&aBuf, "Content-Type: multipart/mixed; boundary=%q\r\n\r\n", aMw.Boundary())
+   aPart, err := aMw.CreatePart(textproto.MIMEHeader{
+      "Content-Type": {"text/plain; charset=utf-8"},
+      "Content-Transfer-Encoding": {"quoted-printable"},
+   })
+   if err != nil { quit(err) }
+   err = _writeQpExport(aPart, iBody)
+   if err != nil { return nil, err }
+   for _, aFile := range iHead.SubHead.Attach {
+      aType := _typeExport(aFile.Name)
+      aPart, err = aMw.CreatePart(textproto.MIMEHeader{
+         "Content-Type": {mime.FormatMediaType(aType, map[string]string{"name": aFile.Name[2:]})},
+         "Content-Disposition": {mime.FormatMediaType("attachment", map[string]string{"filename": aFile.Name[2:]})},
+         "Content-Transfer-Encoding": {"base64"},
+      })
+      if err != nil { quit(err) }
+      aEnc := base64.NewEncoder(base64.StdEncoding, &tWrapWriter{w: aPart})
+      err = o.attachment(aEnc, iHead, &aFile)
+      if err != nil { return nil, err }
+      aEnc.Close()
+   }
+   aMw.Close()
+   return aBuf.Bytes(), nil
+}
+
+// writes content of attachment or form fill
+func (o *tExport) attachment(iW io.Writer, iHead *tMsgHead, iFile *tHeader2Attach) error {
+   if _isFormFill(iFile.Name) {
+      aSuffix := kSuffixRecv; if iHead.From == o.uid { aSuffix = kSuffixSent }
+      _, err := writeRowFilledForm(iW, o.svc, iFile.Ffn + aSuffix, iHead.Id, iFile.Name)
+      return err
+   }
+   aFd, err := os.Open(fileAtc(o.svc, o.tid, iHead.Id, iFile.Name))
+   if err != nil {
+      if !os.IsNotExist(err) { quit(err) }
+      return tError("attachment not found: "+ iFile.Name[2:])
+   }
+   defer aFd.Close()
+   _, err = io.Copy(iW, aFd)
+   return err
+}
+
+type tExportHtml struct {
+   Service, Subject string
+   Msgs []tExportHtmlMsg
+}
+
+type tExportHtmlMsg struct {
+   Id, From, Date, Subject string
+   To []string
+   Body template.HTML
+   Attach []struct {
+      Name string
+      Size int64
+      Data template.URL // data: uri
+      Form string
+   }
+}
+
+//todo stream output; data uris hold every attachment in memory
+func (o *tExport) html(iW io.Writer) error {
+   var aPage tExportHtml
+   aRender := blackfriday.NewHTMLRenderer(blackfriday.HTMLRendererParameters{
+      Flags: blackfriday.CommonHTMLFlags | blackfriday.SkipHTML | blackfriday.Safelink,
+   })
+   err := o.walk("", func(cHead *tMsgHead, cBody []byte) error {
+      cDate, _ := time.Parse(time.RFC3339, cHead.Posted)
+      cMsg := tExportHtmlMsg{Id: cHead.Id, From: cHead.SubHead.Alias, Date: cDate.Format("2006-01-02 15:04 MST")}
+      if cHead.Id != o.tid {
+         cMsg.Subject = cHead.SubHead.Subject // thread subject is page title
+      }
+      if cMsg.From == "" { cMsg.From = cHead.From }
+      for _, cCc := range cHead.SubHead.Cc {
+         cMsg.To = append(cMsg.To, cCc.Who)
+      }
+      cMsg.Body = template.HTML(blackfriday.Run(cBody, blackfriday.WithRenderer(aRender),
+                                                blackfriday.WithExtensions(blackfriday.CommonExtensions)))
+      cMsg.Attach = make([]struct{ Name string; Size int64; Data template.URL; Form string },
+                         len(cHead.SubHead.Attach))
+      for c, cFile := range cHead.SubHead.Attach {
+         cAtc := &cMsg.Attach[c]
+         cAtc.Name, cAtc.Size = cFile.Name[2:], cFile.Size
+         var cBuf bytes.Buffer
+         if _isFormFill(cFile.Name) {
+            err := o.attachment(&cBuf, cHead, &cFile)
+            if err != nil { return err }
+            cAtc.Form = cBuf.String()
+            continue
+         }
+         cBuf.WriteString("data:"+ _typeExport(cFile.Name) +";base64,")
+         cEnc := base64.NewEncoder(base64.StdEncoding, &cBuf)
+         err := o.attachment(cEnc, cHead, &cFile)
+         if err != nil { return err }
+         cEnc.Close()
+         cAtc.Data = template.URL(cBuf.String())
+      }
+      aPage.Msgs = append(aPage.Msgs, cMsg)
+      return nil
+   })
+   if err != nil { return err }
+   aPage.Service, aPage.Subject = o.svc, o.subject
+   return sExportHtmlTmpl.Execute(iW, &aPage)
+}
+
+var sExportHtmlTmpl = template.Must(template.New("export").Parse(`<!DOCTYPE html>
+<html><head>
+<meta charset="utf-8">
+<title>{{.Subject}}</title>
+<style>
+   body { font-family: sans-serif; max-width: 50em; margin: 1em auto; padding: 0 1em; }
+   .msg { border-top: 1px solid #ccc; padding: 0.5em 0; }
+   .head { color: #555; font-size: 90%; }
+   .atc { font-size: 90%; }
+   pre { white-space: pre-wrap; background: #f4f4f4; padding: 0.5em; }
+   blockquote { border-left: 3px solid #ccc; margin-left: 0; padding-left: 1em; }
+</style>
+</head><body>
+<h2>{{.Subject}}</h2>
+<div class="head">{{.Service}}</div>
+{{range .Msgs}}<div class="msg" id="{{.Id}}">
+<div class="head"><b>{{.From}}</b> &middot; {{.Date}}
+{{- if .To}}<br>To: {{range $i, $e := .To}}{{if $i}}, {{end}}{{$e}}{{end}}{{end}}
+{{- if .Subject}}<br>Re: {{.Subject}}{{end}}</div>
+{{.Body}}
+{{- range .Attach}}
+<div class="atc">{{if .Form}}{{.Name}}<pre>{{.Form}}</pre>
+{{- else}}<a download="{{.Name}}" href="{{.Data}}">{{.Name}}</a> ({{.Size}} bytes){{end}}</div>
+{{- end}}
+</div>
+{{end}}</body></html>
+`))
+
+// prefixes '>' to lines matching /^>*From /, per mboxrd
+func _escapeMboxExport(iMsg []byte) []byte {
+   var aBuf bytes.Buffer
+   for _, aLine := range bytes.SplitAfter(iMsg, []byte{'\n'}) {
+      if bytes.HasPrefix(bytes.TrimLeft(aLine, ">"), []byte("From ")) {
+         aBuf.WriteByte('>')
+      }
+      aBuf.Write(aLine)
+   }
+   return aBuf.Bytes()
+}
+
+func _writeQpExport(iW io.Writer, iBody []byte) error {
+   aQp := quotedprintable.NewWriter(iW)
+   _, err := aQp.Write(iBody)
+   if err != nil { return err }
+   return aQp.Close()
+}
+
+// returns media type without parameters
+func _typeExport(iName string) string {
+   if _isFormFill(iName) {
+      return "application/json"
+   }
+   aType, _, err := mime.ParseMediaType(mime.TypeByExtension(path.Ext(iName)))
+   if err != nil {
+      return "application/octet-stream"
+   }
+   return aType
+}
+
+func _addressExport(iName, iUid string) string {
+   return (&mail.Address{Name: iName, Address: _uidAddressExport(iUid)}).String()
+}
+
+func _uidAddressExport(iUid string) string {
+   if strings.IndexByte(iUid, '@') > 0 { // imported
+      return iUid
+   }
+   return iUid +"@"+ kExportDomain
+}
+
+// breaks lines at 76 bytes, for base64 parts
+type tWrapWriter struct {
+   w io.Writer
+   col int
+}
+
+func (o *tWrapWriter) Write(iBuf []byte) (int, error) {
+   aLen := 0
+   for len(iBuf) > 0 {
+      aN := 76 - o.col; if aN > len(iBuf) { aN = len(iBuf) }
+      _, err := o.w.Write(iBuf[:aN])
+      if err != nil { return aLen, err }
+      aLen += aN
+      o.col += aN
+      iBuf = iBuf[aN:]
+      if o.col == 76 {
+         _, err = o.w.Write([]byte("\r\n"))
+         if err != nil { return aLen, err }
+         o.col = 0
+      }
+   }
+   return aLen, nil
+}
@@ -0,0 +1,130 @@
+// Copyright 2017, 2019 Liam Breck
+// Published at https://github.com/networkimprov/mnm-hammer
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/
+
+package slib
+
+import (
+   "archive/zip"
+   "bytes"
+   "encoding/xml"
+   "fmt"
+   "io"
+   "io/ioutil"
+   "os"
+   "path"
+   "strings"
+
+   pPdf "github.com/ledongthuc/pdf"
+)
+
+const kExtractMax = 256 * 1024 // text bytes kept per attachment
+const kExtractFileMax = 64 * 1024 * 1024 // larger documents are not read
+
+var kExtractText = map[string]bool{".txt":true, ".text":true, ".md":true, ".markdown":true,
+                                   ".csv":true, ".tsv":true, ".json":true, ".log":true}
+var kExtractZip = map[string]string{ // archive members with document text
+   ".docx": "word/document.xml", ".xlsx": "xl/sharedStrings.xml", ".pptx": "ppt/slides/slide*.xml",
+   ".odt": "content.xml", ".ods": "content.xml", ".odp": "content.xml" }
+var kExtractBreak = map[string]bool{"p":true, "h":true, "br":true, "tab":true, "s":true, "si":true,
+                                    "tc":true, "line-break":true, "table-cell":true}
+
+// returns the text of attachment file iPath, or "" if the format of iName is not supported
+func textExtract(iPath string, iName string) string {
+   aExt := strings.ToLower(path.Ext(iName))
+   if _isFormFill(iName) {
+      aExt = ".json"
+   }
+   var aText []byte
+   var err error
+   func() {
+      defer func() {
+         if aPanic := recover(); aPanic != nil { // parsers may panic on malformed documents
+            err = fmt.Errorf("%v", aPanic)
+         }
+      }()
+      if kExtractText[aExt] {
+         aText, err = _fileExtract(iPath)
+      } else if aExt == ".pdf" {
+         aText, err = _pdfExtract(iPath)
+      } else if kExtractZip[aExt] != "" {
+         aText, err = _zipExtract(iPath, kExtractZip[aExt])
+      }
+   }()
+   if err != nil {
+      fmt.Fprintf(os.Stderr, "textExtract %s: %s\n", iName, err.Error())
+      return ""
+   }
+   if len(aText) > kExtractMax {
+      aText = aText[:kExtractMax]
+   }
+   return strings.ToValidUTF8(string(aText), "")
+}
+
+func _fileExtract(iPath string) ([]byte, error) {
+   aFd, err := os.Open(iPath)
+   if err != nil { return nil, err }
+   defer aFd.Close()
+   return ioutil.ReadAll(io.LimitReader(aFd, kExtractMax))
+}
+
+func _pdfExtract(iPath string) ([]byte, error) {
+   aFd, err := os.Open(iPath)
+   if err != nil { return nil, err }
+   defer aFd.Close()
+   aFi, err := aFd.Stat()
+   if err != nil { return nil, err }
+   if aFi.Size() > kExtractFileMax {
+      return nil, nil
+   }
+   aR, err := pPdf.NewReader(aFd, aFi.Size())
+   if err != nil { return nil, err }
+   aText, err := aR.GetPlainText()
+   if err != nil { return nil, err }
+   return ioutil.ReadAll(io.LimitReader(aText, kExtractMax))
+}
+
+// reads text from the archive members matching iPattern, e.g. an office document
+func _zipExtract(iPath string, iPattern string) ([]byte, error) {
+   aZr, err := zip.OpenReader(iPath)
+   if err != nil { return nil, err }
+   defer aZr.Close()
+   var aBuf bytes.Buffer
+   for _, aF := range aZr.File {
+      if ok, _ := path.Match(iPattern, aF.Name); !ok {
+         continue
+      }
+      if aF.UncompressedSize64 > kExtractFileMax || aBuf.Len() >= kExtractMax {
+         break
+      }
+      var aRc io.ReadCloser
+      aRc, err = aF.Open()
+      if err != nil { return nil, err }
+      err = _xmlExtract(&aBuf, aRc)
+      aRc.Close()
+      if err != nil { return nil, err }
+   }
+   return aBuf.Bytes(), nil
+}
+
+// appends the character data of an xml document to iBuf, separating paragraphs, cells, etc
+func _xmlExtract(iBuf *bytes.Buffer, iR io.Reader) error {
+   aDec := xml.NewDecoder(iR)
+   for iBuf.Len() < kExtractMax {
+      aTok, err := aDec.Token()
+      if err == io.EOF { return nil }
+      if err != nil { return err }
+      switch aT := aTok.(type) {
+      case xml.CharData:
+         iBuf.Write(aT)
+      case xml.EndElement:
+         if kExtractBreak[aT.Name.Local] {
+            iBuf.WriteByte('\n')
+         }
+      }
+   }
+   return nil
+}
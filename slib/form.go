@@ -11,14 +11,20 @@ import (
    "bytes"
    "fmt"
    "io"
+   "io/ioutil"
    "encoding/json"
+   "net/http"
    "os"
+   "regexp"
    "sort"
    "strconv"
    "strings"
    "sync"
    "time"
+   "unicode/utf8"
    "net/url"
+
+   pJs "github.com/santhosh-tekuri/jsonschema/v5"
 )
 
 type tGlobalBlankForm struct{} // implements GlobalSet
@@ -37,21 +43,21 @@ type tBlankFormRev struct { Id string; Date string }
 
 func initForms() {
    var err error
-   aDir, err := readDirFis(kFormDir)
+   aDir, err := readDirFis(sFormDir)
    if err != nil { quit(err) }
    sort.Slice(aDir, func (cA, cB int) bool { return aDir[cA].ModTime().Before(aDir[cB].ModTime()) })
 
    for _, aFi := range aDir {
       aFn := aFi.Name()
       if strings.HasSuffix(aFn, ".tmp") {
-         err = os.Remove(kFormDir + aFn)
+         err = os.Remove(sFormDir + aFn)
          if err != nil { quit(err) }
          continue
       } else if strings.HasSuffix(aFn, ".tok") {
          aFn = aFn[:len(aFn)-4]
-         err = os.Remove(kFormDir + aFn)
+         err = os.Remove(sFormDir + aFn)
          if err != nil && !os.IsNotExist(err) { quit(err) }
-         err = os.Rename(kFormDir + aFn + ".tok", kFormDir + aFn)
+         err = os.Rename(sFormDir + aFn + ".tok", sFormDir + aFn)
          if err != nil { quit(err) }
       }
       aName, aRev := _parseFileName(aFn)
@@ -69,7 +75,7 @@ func (tGlobalBlankForm) GetIdx() interface{} {
 }
 
 func (tGlobalBlankForm) GetPath(iFileName string) string {
-   return kFormDir + iFileName
+   return sFormDir + iFileName
 }
 
 func (tGlobalBlankForm) Add(iFileName, iDupeRev string, iR io.Reader) error {
@@ -91,19 +97,34 @@ func (tGlobalBlankForm) Add(iFileName, iDupeRev string, iR io.Reader) error {
       iDupeRev == "original" || iDupeRev == "spec" {
       return tError("invalid form name")
    }
-   aPath := kFormDir + aName + "." + aRev
+   aPath := sFormDir + aName + "." + aRev
    aTemp := aPath + ".tmp"
    aTempOk := aPath + ".tok"
 
    if iDupeRev != "" {
       var aDd *os.File
-      aDd, err = os.Open(kFormDir + iFileName)
+      aDd, err = os.Open(sFormDir + iFileName)
       if err != nil {
          if !os.IsNotExist(err) { quit(err) }
          return tError("source not found")
       }
       defer aDd.Close()
       iR = aDd
+   } else if aRev == "spec" {
+      var aBuf []byte
+      aBuf, err = ioutil.ReadAll(iR)
+      if err != nil { return err }
+      var aSchema *pJs.Schema
+      aSchema, err = _schemaSpec(aBuf)
+      if err == nil && aSchema == nil {
+         var aJson tFormReg
+         err = json.Unmarshal(aBuf, &aJson)
+         if err == nil {
+            err = _checkSpec("", aJson.Spec)
+         }
+      }
+      if err != nil { return tError("spec: "+ err.Error()) }
+      iR = bytes.NewReader(aBuf)
    }
 
    sBlankFormsDoor.Lock(); defer sBlankFormsDoor.Unlock()
@@ -117,7 +138,7 @@ func (tGlobalBlankForm) Add(iFileName, iDupeRev string, iR io.Reader) error {
    if err != nil { return err }
    err = os.Rename(aTemp, aTempOk)
    if err != nil { quit(err) }
-   err = syncDir(kFormDir)
+   err = syncDir(sFormDir)
    if err != nil { quit(err) }
    err = os.Remove(aPath)
    if err != nil && !os.IsNotExist(err) { quit(err) }
@@ -128,7 +149,7 @@ func (tGlobalBlankForm) Add(iFileName, iDupeRev string, iR io.Reader) error {
 
 func (tGlobalBlankForm) Drop(iFileName string) error {
    aName, aRev := _parseFileName(iFileName)
-   aPath := kFormDir + aName + "." + aRev
+   aPath := sFormDir + aName + "." + aRev
 
    sBlankFormsDoor.Lock(); defer sBlankFormsDoor.Unlock()
    aBf := sBlankForms[aName]
@@ -169,7 +190,7 @@ func readFfnBlankForm(iFileName string) string {
       return "local/" + aName
    }
    var aJson struct { Ffn string }
-   err := readJsonFile(&aJson, kFormDir + aName + ".spec")
+   err := readJsonFile(&aJson, sFormDir + aName + ".spec")
    if err != nil {
       if os.IsNotExist(err) { quit(err) }
       return "#" + err.Error()
@@ -235,41 +256,225 @@ func writeTableFilledForm(iW io.Writer, iSvc string, iFft string) error {
    return err
 }
 
+func readTableFilledForm(iSvc string, iFft string) ([]Msg, error) {
+   aDoor := _getFormDoor(iSvc, iFft)
+   aDoor.RLock(); defer aDoor.RUnlock()
+   aFd, err := os.Open(fileForm(iSvc, iFft))
+   if err != nil {
+      if !os.IsNotExist(err) { quit(err) }
+      return nil, tError("form table not found")
+   }
+   defer aFd.Close()
+   var aRows []Msg
+   aDc := json.NewDecoder(aFd)
+   aDc.UseNumber()
+   err = aDc.Decode(&aRows)
+   if err != nil { damage(aFd.Name(), err) }
+   return aRows, nil
+}
+
+// returns the spec for iFfn if stored in sFormDir or reg-cache, without a registry request
+func getSpecFilledForm(iSvc string, iFfn string) []tSpecEl {
+   aPath := fileFormReg(iFfn)
+   aLocalUri := getUriService(iSvc)
+   if strings.HasPrefix(iFfn, aLocalUri) {
+      aName := iFfn[len(aLocalUri):]
+      if strings.ContainsAny(aName, "/\\") { return nil }
+      aPath = sFormDir + aName + ".spec"
+   }
+   aBuf, err := ioutil.ReadFile(aPath)
+   if err != nil {
+      if !os.IsNotExist(err) { quit(err) }
+      return nil
+   }
+   var aJson tFormReg
+   err = json.Unmarshal(aBuf, &aJson)
+   if err == nil && aJson.Spec != nil {
+      return aJson.Spec
+   }
+   if aJson.Schema != nil { // from registry
+      aBuf = aJson.Schema
+   }
+   return _propsSchemaSpec(aBuf)
+}
+
+type tFormQuery struct {
+   Table string // e.g. "example.org/form_recv"
+   Where []struct { Field, Op string; Value interface{} } // all must match
+   Group string // column by which to group rows; "" for one group
+   Agg []struct { Fn, Field string } // per group
+}
+
+var kFormQueryOp = map[string]bool{"=":true, "!=":true, "<":true, "<=":true, ">":true, ">=":true,
+                                   "contains":true}
+var kFormQueryFn = map[string]bool{"count":true, "sum":true, "avg":true, "min":true, "max":true}
+
+type tFormQueryEl struct {
+   Key interface{} // value of Group column
+   Count int
+   Agg []interface{} // per tFormQuery.Agg; nil if no numbers for avg, min, max
+}
+
+// filters, groups, and aggregates the rows of a filled-form table; iQuery is a tFormQuery in json
+// with columns named as by flattenTableExport(), e.g. "or.anr[1][0]" and "$date"
+func QueryFilledForm(iSvc string, iQuery string) (interface{}, error) {
+   var aQ tFormQuery
+   aDc := json.NewDecoder(strings.NewReader(iQuery))
+   aDc.UseNumber()
+   err := aDc.Decode(&aQ)
+   if err != nil { return nil, tError("query json: "+ err.Error()) }
+   for _, aW := range aQ.Where {
+      if !kFormQueryOp[aW.Op] { return nil, tError("invalid query op "+ aW.Op) }
+   }
+   for _, aA := range aQ.Agg {
+      if !kFormQueryFn[aA.Fn] || aA.Field == "" && aA.Fn != "count" {
+         return nil, tError("invalid query aggregate "+ aA.Fn +" "+ aA.Field)
+      }
+   }
+   aRows, _, err := flattenTableExport(iSvc, aQ.Table)
+   if err != nil { return nil, err }
+
+   type tAcc struct { sum, min, max float64; n int }
+   aGroups := make(map[string]*tFormQueryEl)
+   aAccs := make(map[*tFormQueryEl][]tAcc)
+   aList := []*tFormQueryEl{}
+   for _, aRow := range aRows {
+      aMatch := true
+      for a := 0; a < len(aQ.Where) && aMatch; a++ {
+         aMatch = _matchFormQuery(aRow[aQ.Where[a].Field], aQ.Where[a].Op, aQ.Where[a].Value)
+      }
+      if !aMatch { continue }
+      aKey := aRow[aQ.Group]
+      aMapKey := fmt.Sprintf("%T %v", aKey, aKey)
+      aEl := aGroups[aMapKey]
+      if aEl == nil {
+         aEl = &tFormQueryEl{Key: aKey, Agg: make([]interface{}, len(aQ.Agg))}
+         aGroups[aMapKey] = aEl
+         aAccs[aEl] = make([]tAcc, len(aQ.Agg))
+         aList = append(aList, aEl)
+      }
+      aEl.Count++
+      for a, aA := range aQ.Agg {
+         aAcc := &aAccs[aEl][a]
+         if aA.Fn == "count" {
+            if aA.Field == "" || aRow[aA.Field] != nil { aAcc.n++ }
+            continue
+         }
+         aNum, ok := aRow[aA.Field].(json.Number)
+         if !ok { continue }
+         aF, err := aNum.Float64()
+         if err != nil { continue }
+         if aAcc.n == 0 || aF < aAcc.min { aAcc.min = aF }
+         if aAcc.n == 0 || aF > aAcc.max { aAcc.max = aF }
+         aAcc.sum += aF
+         aAcc.n++
+      }
+   }
+   for _, aEl := range aList {
+      for a, aA := range aQ.Agg {
+         aAcc := &aAccs[aEl][a]
+         switch aA.Fn {
+         case "count": aEl.Agg[a] = aAcc.n
+         case "sum":   aEl.Agg[a] = aAcc.sum
+         default:
+            if aAcc.n == 0 { continue }
+            switch aA.Fn {
+            case "avg": aEl.Agg[a] = aAcc.sum / float64(aAcc.n)
+            case "min": aEl.Agg[a] = aAcc.min
+            case "max": aEl.Agg[a] = aAcc.max
+            }
+         }
+      }
+   }
+   sort.SliceStable(aList, func(cA, cB int) bool {
+      cCmp, ok := _compareFormQuery(aList[cA].Key, aList[cB].Key)
+      if !ok { return fmt.Sprintf("%T", aList[cA].Key) < fmt.Sprintf("%T", aList[cB].Key) }
+      return cCmp < 0
+   })
+   return aList, nil
+}
+
+func _matchFormQuery(iV interface{}, iOp string, iValue interface{}) bool {
+   if iOp == "contains" {
+      aStr, ok := iV.(string)
+      aSub, okSub := iValue.(string)
+      return ok && okSub && strings.Contains(strings.ToLower(aStr), strings.ToLower(aSub))
+   }
+   aCmp, ok := _compareFormQuery(iV, iValue)
+   if !ok {
+      return false // missing or other type; fails != as well as =
+   }
+   switch iOp {
+   case "=":  return aCmp == 0
+   case "!=": return aCmp != 0
+   case "<":  return aCmp < 0
+   case "<=": return aCmp <= 0
+   case ">":  return aCmp > 0
+   default:   return aCmp >= 0
+   }
+}
+
+// returns the order of iA & iB, and whether they are comparable (both number, string, or bool)
+func _compareFormQuery(iA, iB interface{}) (int, bool) {
+   switch aA := iA.(type) {
+   case json.Number:
+      aB, ok := iB.(json.Number)
+      if !ok { return 0, false }
+      aFa, errA := aA.Float64()
+      aFb, errB := aB.Float64()
+      if errA != nil || errB != nil { return 0, false }
+      if aFa < aFb { return -1, true }
+      if aFa > aFb { return 1, true }
+      return 0, true
+   case string:
+      aB, ok := iB.(string)
+      if !ok { return 0, false }
+      return strings.Compare(aA, aB), true
+   case bool:
+      aB, ok := iB.(bool)
+      if !ok { return 0, false }
+      if aA == aB { return 0, true }
+      if aB { return -1, true }
+      return 1, true
+   }
+   return 0, false
+}
+
 func writeRowFilledForm(iW io.Writer, iSvc string, iFft string,
                         iMsgId string, iName string) (int64, error) {
    var err error
    aDoor := _getFormDoor(iSvc, iFft)
    aDoor.RLock(); defer aDoor.RUnlock()
    aFd, err := os.Open(fileForm(iSvc, iFft))
-   if err != nil { quit(err) }
+   if err != nil { damage(fileForm(iSvc, iFft), err) }
    defer aFd.Close()
 
    aDc := json.NewDecoder(aFd)
    aDc.UseNumber()
    _, err = aDc.Token()
-   if err != nil { quit(err) }
+   if err != nil { damage(aFd.Name(), err) }
 
    var aRow Msg
    for aRow = nil; aDc.More(); aRow = nil {
       err = aDc.Decode(&aRow)
-      if err != nil { quit(err) }
+      if err != nil { damage(aFd.Name(), err) }
       if aRow["$msgid"].(string) == iMsgId &&
          (aRow["$name"] == nil || aRow["$name"].(string) == iName) { // nil test for pre-0.8
          break
       }
    }
    if aRow == nil {
-      quit(fmt.Errorf("%s formfill table %s lacks msgid %s\n", iSvc, iFft, iMsgId))
+      damage(aFd.Name(), tError("lacks msgid "+ iMsgId))
    }
    aLen, err := aRow["$size"].(json.Number).Int64()
-   if err != nil { quit(err) }
+   if err != nil { damage(aFd.Name(), err) }
    aTxt := aRow["$text"]
    if aTxt != nil {
       _, err = io.WriteString(iW, aTxt.(string))
       return aLen, err
    }
    aPos, err := aRow["$offset"].(json.Number).Int64()
-   if err != nil { quit(err) }
+   if err != nil { damage(aFd.Name(), err) }
 
    _, err = aFd.Seek(aPos, io.SeekStart)
    if err != nil { quit(err) }
@@ -286,23 +491,37 @@ func validateFilledForm(iSvc string, iBuf []byte, iFfn string) error {
    err = json.Unmarshal(iBuf, &aForm)
    if err != nil { return err }
 
-   var aPath string
+   var aJson tFormReg
    aLocalUri := getUriService(iSvc)
    if strings.HasPrefix(iFfn, aLocalUri) {
-      aPath = kFormDir + iFfn[len(aLocalUri):] + ".spec"
+      var aBuf []byte
+      aBuf, err = ioutil.ReadFile(sFormDir + iFfn[len(aLocalUri):] + ".spec")
+      if err != nil {
+         if !os.IsNotExist(err) { quit(err) }
+      } else {
+         aSchema, err := _schemaSpec(aBuf)
+         if err != nil { return err }
+         if aSchema != nil {
+            return _validateSchema(aSchema, aForm)
+         }
+         err = json.Unmarshal(aBuf, &aJson)
+         if err != nil { return err }
+      }
    } else if strings.HasPrefix(iFfn, aLocalUri[:1 + strings.IndexByte(aLocalUri, '/')]) {
       return nil // assume host does not provide a FFN registry
    } else {
-      aPath = fileFormReg(iFfn)
-      err = _retrieveSpec(iFfn)
+      err = _retrieveSpec(&aJson, iFfn)
       if err != nil { return err }
+      if aJson.Schema != nil {
+         aSchema, err := _schemaSpec(aJson.Schema)
+         if err != nil { return err }
+         return _validateSchema(aSchema, aForm)
+      }
    }
-   var aJson struct { Spec []tSpecEl; Ffn string }
-   err = readJsonFile(&aJson, aPath)
-   if err != nil && !os.IsNotExist(err) { return err }
    if aJson.Spec == nil {
       return nil //todo indicate spec not found?
    }
+   _compileSpec(iFfn, aJson.Spec)
 
    var aResult []byte
    _validateObject(&aResult, "", aForm, aJson.Spec)
@@ -311,27 +530,296 @@ func validateFilledForm(iSvc string, iBuf []byte, iFfn string) error {
 }
 
 type tSpecEl struct {
-   Name, Type string
+   Name, Type string // Type: bool, string, number, date, datetime, object
+   Label string `json:",omitempty"` // human-readable name
    Status string // required, optional, deprecated
    Array int // N-dimensional array of the specified type
    Spec []tSpecEl // for Type "object"
+   Enum []interface{} `json:",omitempty"` // permitted values
+   Min *float64 `json:",omitempty"` // least number, or string length
+   Max *float64 `json:",omitempty"` // greatest number, or string length
+   Pattern string `json:",omitempty"` // regexp which must match the whole string
+   Default interface{} `json:",omitempty"` // initial value for a form editor; not applied to filled forms
+   re *regexp.Regexp // compiled Pattern, set by _checkSpec() or _compileSpec()
 }
 
-func _retrieveSpec(iFfn string) error {
-   //todo download from registry
-   aTd, err := os.Open("./formspec")
-   if err != nil { quit(err) }
-   aFd, err := os.OpenFile(fileFormReg(iFfn), os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+var kSpecType = map[string]bool{"bool":true, "string":true, "number":true, "date":true, "datetime":true,
+                                "object":true}
+var kSpecStatus = map[string]bool{"required":true, "optional":true, "deprecated":true}
+
+const kFormRegMaxAge = 24 * time.Hour // when registry gives no Cache-Control or Expires
+const kFormRegSizeMax = 1024 * 1024
+
+var sFormRegistry = "https://" // prefixed to a FFN to make its spec url
+var sFormRegClient = &http.Client{Timeout: 30 * time.Second}
+var sFormRegDoor sync.Mutex
+
+// for tests, e.g. "http://localhost:8080/"
+func SetRegistryForm(iUrl string) { sFormRegistry = iUrl }
+
+type tFormReg struct { // reg-cache file
+   Ffn string
+   Spec []tSpecEl
+   Schema json.RawMessage `json:",omitempty"` // JSON Schema, when registry gave one instead of Spec
+   Etag string `json:",omitempty"`
+   Expires time.Time
+}
+
+func (o *tFormReg) hasSpec() bool { return o.Spec != nil || o.Schema != nil }
+
+// loads the spec for iFfn from reg-cache; refreshes it from the registry when expired,
+// falling back to the cached copy if the registry is unreachable
+func _retrieveSpec(iReg *tFormReg, iFfn string) error {
+   sFormRegDoor.Lock(); defer sFormRegDoor.Unlock()
+   aPath := fileFormReg(iFfn)
+   err := readJsonFile(iReg, aPath)
+   if err != nil {
+      *iReg = tFormReg{} // missing or corrupt
+   }
+   if iReg.hasSpec() && time.Now().Before(iReg.Expires) {
+      return nil
+   }
+   aNew := tFormReg{Ffn: iFfn}
+   err = _fetchSpec(&aNew, iReg)
+   if err != nil {
+      if !iReg.hasSpec() { return tError("form registry: "+ err.Error()) }
+      fmt.Fprintf(os.Stderr, "_retrieveSpec %s: %s; using cached spec\n", iFfn, err.Error())
+      return nil
+   }
+   *iReg = aNew
+   aTemp := sFormRegDir + ".tmp" // escapeFile() result never starts with '.'
+   err = os.Remove(aTemp)
+   if err != nil && !os.IsNotExist(err) { quit(err) }
+   err = writeJsonFile(aTemp, iReg)
    if err != nil { quit(err) }
-   _, err = io.Copy(aFd, aTd)
+   err = os.Rename(aTemp, aPath)
    if err != nil { quit(err) }
-   err = aFd.Sync()
+   err = syncDir(sFormRegDir)
    if err != nil { quit(err) }
-   aFd.Close()
-   aTd.Close()
    return nil
 }
 
+// requests iReg.Ffn from the registry, revalidating iCache via its ETag
+func _fetchSpec(iReg *tFormReg, iCache *tFormReg) error {
+   aUrl, err := url.Parse(sFormRegistry + iReg.Ffn)
+   if err != nil { return err }
+   if aUrl.Host == "" { return tError("ffn lacks hostname") }
+   aReq, err := http.NewRequest("GET", aUrl.String(), nil)
+   if err != nil { return err }
+   if iCache.hasSpec() && iCache.Etag != "" {
+      aReq.Header.Set("If-None-Match", iCache.Etag)
+   }
+   aRsp, err := sFormRegClient.Do(aReq)
+   if err != nil { return err }
+   defer aRsp.Body.Close()
+   switch aRsp.StatusCode {
+   case http.StatusNotModified:
+      if !iCache.hasSpec() { return tError("unexpected "+ aRsp.Status) }
+      iReg.Spec, iReg.Schema, iReg.Etag = iCache.Spec, iCache.Schema, iCache.Etag
+   case http.StatusOK:
+      var aBuf []byte
+      aBuf, err = ioutil.ReadAll(io.LimitReader(aRsp.Body, kFormRegSizeMax))
+      if err != nil { return err }
+      var aSchema *pJs.Schema
+      aSchema, err = _schemaSpec(aBuf)
+      if err != nil { return tError("spec json: "+ err.Error()) }
+      if aSchema != nil {
+         iReg.Schema, iReg.Etag = aBuf, aRsp.Header.Get("ETag")
+         break
+      }
+      var aJson struct { Ffn string; Spec []tSpecEl }
+      err = json.Unmarshal(aBuf, &aJson)
+      if err != nil { return tError("spec json: "+ err.Error()) }
+      if aJson.Ffn != iReg.Ffn { return tError("spec ffn mismatch: "+ aJson.Ffn) }
+      if aJson.Spec == nil { return tError("spec missing") }
+      err = _checkSpec("", aJson.Spec)
+      if err != nil {
+         fmt.Fprintf(os.Stderr, "_fetchSpec %s: %s\n", iReg.Ffn, err.Error()) // still applied
+      }
+      iReg.Spec, iReg.Etag = aJson.Spec, aRsp.Header.Get("ETag")
+   default:
+      return tError("registry response "+ aRsp.Status)
+   }
+   iReg.Expires = _expiresSpec(aRsp.Header)
+   return nil
+}
+
+func _expiresSpec(iHead http.Header) time.Time {
+   aNow := time.Now()
+   for _, aDir := range strings.Split(iHead.Get("Cache-Control"), ",") {
+      aDir = strings.TrimSpace(aDir)
+      if aDir == "no-cache" || aDir == "no-store" {
+         return aNow
+      }
+      if strings.HasPrefix(aDir, "max-age=") {
+         aSec, err := strconv.Atoi(aDir[8:])
+         if err == nil { return aNow.Add(time.Duration(aSec) * time.Second) }
+      }
+   }
+   aExp, err := http.ParseTime(iHead.Get("Expires"))
+   if err == nil { return aExp }
+   return aNow.Add(kFormRegMaxAge)
+}
+
+// vets a spec when it's added
+func _checkSpec(iParent string, iSpec []tSpecEl) error {
+   aNames := make(map[string]bool, len(iSpec))
+   for a := range iSpec {
+      aEl := &iSpec[a]
+      fErr := func(c string) error { return tError("spec "+ iParent + aEl.Name +" "+ c) }
+      if aEl.Name == "" || aNames[aEl.Name] {
+         return fErr("name empty or duplicate")
+      }
+      aNames[aEl.Name] = true
+      if !kSpecType[aEl.Type] || !kSpecStatus[aEl.Status] || aEl.Array < 0 {
+         return fErr("invalid type, status, or array")
+      }
+      if aEl.Type == "object" {
+         if len(aEl.Spec) == 0 { return fErr("object lacks spec") }
+         if aEl.Enum != nil || aEl.Default != nil { return fErr("object cannot have enum or default") }
+         err := _checkSpec(iParent + aEl.Name +".", aEl.Spec)
+         if err != nil { return err }
+      } else if aEl.Spec != nil {
+         return fErr("has spec but is not object")
+      }
+      if (aEl.Min != nil || aEl.Max != nil) && aEl.Type != "number" && aEl.Type != "string" {
+         return fErr("min & max apply to number or string")
+      }
+      if aEl.Min != nil && aEl.Max != nil && *aEl.Min > *aEl.Max {
+         return fErr("min exceeds max")
+      }
+      if aEl.Pattern != "" {
+         if aEl.Type != "string" { return fErr("pattern applies to string") }
+         _, err := regexp.Compile(aEl.Pattern)
+         if err != nil { return fErr("pattern "+ err.Error()) }
+         aEl.re = regexp.MustCompile("^(?:"+ aEl.Pattern +")$")
+      }
+      var aResult []byte
+      for _, aV := range aEl.Enum {
+         if !_validateType(&aResult, "", aV, &tSpecEl{Type: aEl.Type, Min: aEl.Min, Max: aEl.Max,
+                                                   Pattern: aEl.Pattern, re: aEl.re}, 0) || aResult != nil {
+            return fErr("enum value not valid for type & constraints")
+         }
+      }
+      if aEl.Default != nil {
+         if !_validateType(&aResult, "", aEl.Default, aEl, aEl.Array) || aResult != nil {
+            return fErr("default not valid for spec")
+         }
+      }
+   }
+   return nil
+}
+
+// compiles the patterns of a stored or fetched spec without the checks of _checkSpec(),
+// so specs that predate them keep working; an invalid pattern is logged and not applied
+func _compileSpec(iFfn string, iSpec []tSpecEl) {
+   for a := range iSpec {
+      aEl := &iSpec[a]
+      if aEl.Pattern != "" {
+         _, err := regexp.Compile(aEl.Pattern)
+         if err != nil {
+            fmt.Fprintf(os.Stderr, "_compileSpec %s: %s pattern %s\n", iFfn, aEl.Name, err.Error())
+         } else {
+            aEl.re = regexp.MustCompile("^(?:"+ aEl.Pattern +")$")
+         }
+      }
+      _compileSpec(iFfn, aEl.Spec)
+   }
+}
+
+// returns a compiled JSON Schema if iBuf has a $schema, else nil
+func _schemaSpec(iBuf []byte) (*pJs.Schema, error) {
+   var aDoc struct { Schema *string `json:"$schema"` }
+   err := json.Unmarshal(iBuf, &aDoc)
+   if err != nil { return nil, err }
+   if aDoc.Schema == nil {
+      return nil, nil
+   }
+   aC := pJs.NewCompiler()
+   aC.AssertFormat = true
+   aC.LoadURL = func(cUrl string) (io.ReadCloser, error) {
+      return nil, tError("$ref to external schema "+ cUrl +" not supported")
+   }
+   err = aC.AddResource(kFormSchemaUrl, bytes.NewReader(iBuf))
+   if err != nil { return nil, err }
+   return aC.Compile(kFormSchemaUrl)
+}
+
+const kFormSchemaUrl = "mem:///spec"
+
+// returns the properties of JSON Schema iBuf in document order, with Spec set for those having
+// properties; other tSpecEl fields are not derived
+func _propsSchemaSpec(iBuf []byte) []tSpecEl {
+   var aSpec []tSpecEl
+   aDc := json.NewDecoder(bytes.NewReader(iBuf))
+   aTok, err := aDc.Token()
+   if err != nil || aTok != json.Delim('{') { return nil }
+   for aDc.More() {
+      aKey, _ := aDc.Token()
+      var aVal json.RawMessage
+      err = aDc.Decode(&aVal)
+      if err != nil { return nil }
+      if aKey != "properties" { continue }
+      aDp := json.NewDecoder(bytes.NewReader(aVal))
+      aTok, err = aDp.Token()
+      if err != nil || aTok != json.Delim('{') { return nil }
+      for aDp.More() {
+         aName, _ := aDp.Token()
+         var aProp json.RawMessage
+         err = aDp.Decode(&aProp)
+         if err != nil { return nil }
+         aEl := tSpecEl{Name: aName.(string), Spec: _propsSchemaSpec(aProp)}
+         if aEl.Spec != nil { aEl.Type = "object" }
+         aSpec = append(aSpec, aEl)
+      }
+   }
+   return aSpec
+}
+
+func _validateSchema(iSchema *pJs.Schema, iForm map[string]interface{}) error {
+   err := iSchema.Validate(iForm)
+   if err == nil {
+      return nil
+   }
+   aVe, ok := err.(*pJs.ValidationError)
+   if !ok { return err }
+   var aResult []byte
+   var fLeaf func(*pJs.ValidationError)
+   fLeaf = func(cVe *pJs.ValidationError) {
+      for _, cCause := range cVe.Causes {
+         fLeaf(cCause)
+      }
+      if len(cVe.Causes) == 0 {
+         aPath := _pathSchema(cVe.InstanceLocation, iForm); if aPath != "" { aPath += " " }
+         aResult = append(aResult, aPath + cVe.Message +"; "...)
+      }
+   }
+   fLeaf(aVe)
+   return tError("form-fill " + string(aResult))
+}
+
+// converts JSON pointer iPtr into iForm to a path like "or.anr[1][0]"
+func _pathSchema(iPtr string, iForm interface{}) string {
+   aPath := ""
+   aV := iForm
+   for _, aSeg := range strings.Split(iPtr, "/")[1:] {
+      aSeg = strings.NewReplacer("~1", "/", "~0", "~").Replace(aSeg)
+      switch aT := aV.(type) {
+      case []interface{}:
+         aPath += "["+ aSeg +"]"
+         aN, err := strconv.Atoi(aSeg)
+         if err == nil && aN < len(aT) { aV = aT[aN] }
+      case map[string]interface{}:
+         if aPath != "" { aPath += "." }
+         aPath += aSeg
+         aV = aT[aSeg]
+      default:
+         aPath += "."+ aSeg
+      }
+   }
+   return aPath
+}
+
 func _validateObject(iResult *[]byte, iParent string, iForm map[string]interface{}, iSpec []tSpecEl) {
    fAppend := func(c string) { *iResult = append(*iResult, iParent+c+"; "...) }
    for _, aEl := range iSpec {
@@ -341,7 +829,7 @@ func _validateObject(iResult *[]byte, iParent string, iForm map[string]interface
       } else if aEl.Status == "deprecated" {
          if aField != nil { fAppend(aEl.Name+" deprecated") }
       }
-      if !_validateType(iResult, iParent, aField, &aEl, aEl.Array) {
+      if !_validateType(iResult, iParent+aEl.Name, aField, &aEl, aEl.Array) {
          aWant := aEl.Type; if aEl.Array > 0 { aWant = fmt.Sprint(aEl.Array)+"D array of "+aEl.Type }
          fAppend(aEl.Name+" must be "+aWant)
       }
@@ -352,21 +840,63 @@ func _validateObject(iResult *[]byte, iParent string, iForm map[string]interface
    }
 }
 
-func _validateType(iResult *[]byte, iParent string, iField interface{}, iEl *tSpecEl, iArray int) bool {
+// iPath locates iField in the form, e.g. "or.anr[1][0]"
+func _validateType(iResult *[]byte, iPath string, iField interface{}, iEl *tSpecEl, iArray int) bool {
    switch iField.(type) {
    case bool:                   if iArray > 0 || iEl.Type != "bool"   { return false }
-   case string:                 if iArray > 0 || iEl.Type != "string" { return false }
+   case string:                 if iArray > 0 || iEl.Type != "string" &&
+                                                 iEl.Type != "date" && iEl.Type != "datetime" { return false }
    case float64:                if iArray > 0 || iEl.Type != "number" { return false }
    case map[string]interface{}: if iArray > 0 || iEl.Type != "object" { return false }
-      _validateObject(iResult, iParent+iEl.Name+".", iField.(map[string]interface{}), iEl.Spec)
+      _validateObject(iResult, iPath+".", iField.(map[string]interface{}), iEl.Spec)
+      return true
    case []interface{}:          if iArray < 1          { return false }
-      for _, aI := range iField.([]interface{}) {
-         if !_validateType(iResult, iParent, aI, iEl, iArray-1) { return false }
+      for a, aI := range iField.([]interface{}) {
+         if !_validateType(iResult, fmt.Sprintf("%s[%d]", iPath, a), aI, iEl, iArray-1) { return false }
       }
+      return true
+   default:
+      return true
+   }
+   aMsg := _validateValue(iField, iEl)
+   if aMsg != "" {
+      *iResult = append(*iResult, iPath+" "+aMsg+"; "...)
    }
    return true
 }
 
+// returns the constraint of iEl which scalar iField violates, or ""
+func _validateValue(iField interface{}, iEl *tSpecEl) string {
+   fRange := func(cN float64, cWhat string) string {
+      if iEl.Min != nil && cN < *iEl.Min { return cWhat +"must be >= "+ fmt.Sprint(*iEl.Min) }
+      if iEl.Max != nil && cN > *iEl.Max { return cWhat +"must be <= "+ fmt.Sprint(*iEl.Max) }
+      return ""
+   }
+   switch aV := iField.(type) {
+   case float64:
+      if aMsg := fRange(aV, ""); aMsg != "" { return aMsg }
+   case string:
+      switch iEl.Type {
+      case "date":
+         if _, err := time.Parse("2006-01-02", aV); err != nil { return "must be date YYYY-MM-DD" }
+      case "datetime":
+         if _, err := time.Parse(time.RFC3339, aV); err != nil { return "must be RFC 3339 datetime" }
+      default:
+         if aMsg := fRange(float64(utf8.RuneCountInString(aV)), "length "); aMsg != "" { return aMsg }
+         if iEl.re != nil && !iEl.re.MatchString(aV) { return "must match "+ iEl.Pattern }
+      }
+   }
+   if iEl.Enum != nil {
+      for _, aE := range iEl.Enum {
+         if aE == iField { return "" }
+      }
+      aList, err := json.Marshal(iEl.Enum)
+      if err != nil { quit(err) }
+      return "must be one of "+ string(aList)
+   }
+   return ""
+}
+
 func tempFilledForm(iSvc string, iThreadId, iMsgId string, iSuffix string, iFile *tHeader2Attach,
                     iFftSize map[string]int64, iR io.Reader) error {
    aTemp := ftmpAtc(iSvc, iMsgId, iFile.Name)
@@ -0,0 +1,250 @@
+// Copyright 2017, 2019 Liam Breck
+// Published at https://github.com/networkimprov/mnm-hammer
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/
+
+package slib
+
+import (
+   "encoding/json"
+   "fmt"
+   "hash/crc32"
+   "io/ioutil"
+   "os"
+   "strconv"
+   "strings"
+)
+
+func dirQuarantine(iSvc string) string { return sStorageDir + "quarantine/" + escapeFile(iSvc) + "/" }
+
+type tFsck struct {
+   svc string
+   problems int
+}
+
+func (o *tFsck) report(iFormat string, iArgs ...interface{}) {
+   o.problems++
+   fmt.Printf("fsck %s: "+ iFormat +"\n", append([]interface{}{o.svc}, iArgs...)...)
+}
+
+// checks stored data of services in iSvcs, or all if empty; runs without Init()
+// returns count of problems found
+func FsckService(iSvcs []string, iQuarantine bool) int {
+   if len(iSvcs) == 0 {
+      aDir, err := readDirNames(sServiceDir)
+      if err != nil {
+         fmt.Fprintf(os.Stderr, "FsckService: %s\n", err.Error())
+         return 1
+      }
+      for _, aName := range aDir {
+         if strings.HasSuffix(aName, ".tmp") { continue }
+         iSvcs = append(iSvcs, unescapeFile(aName))
+      }
+   }
+   aProblems := 0
+   for _, aSvc := range iSvcs {
+      aCk := tFsck{svc: aSvc}
+      _, err := os.Stat(dirSvc(aSvc))
+      if err != nil {
+         aCk.report("%s", err.Error())
+      } else {
+         _fsckConfig(&aCk)
+         _fsckThreads(&aCk, iQuarantine)
+         _fsckForms(&aCk)
+      }
+      fmt.Printf("fsck %s: %d problems\n", aSvc, aCk.problems)
+      aProblems += aCk.problems
+   }
+   return aProblems
+}
+
+func _fsckConfig(o *tFsck) {
+   var aCfg tSvcConfig
+   aBuf, err := ioutil.ReadFile(fileCfg(o.svc))
+   if err == nil {
+      err = json.Unmarshal(aBuf, &aCfg)
+   }
+   if err != nil {
+      o.report("config: %s", err.Error())
+   }
+   for _, aPath := range [...]string{filePing(o.svc), fileAdrs(o.svc), fileOhi(o.svc), fileTag(o.svc),
+                                     fileTab(o.svc), fileSaved(o.svc), fileSendq(o.svc), fileNotc(o.svc)} {
+      aBuf, err = ioutil.ReadFile(aPath)
+      if err != nil {
+         if !os.IsNotExist(err) { o.report("%s", err.Error()) }
+         continue
+      }
+      if !json.Valid(aBuf) {
+         o.report("%s: invalid json", aPath[len(dirSvc(o.svc)):])
+      }
+   }
+}
+
+func _fsckThreads(o *tFsck, iQuarantine bool) {
+   aDir, err := readDirNames(dirThread(o.svc))
+   if err != nil {
+      o.report("%s", err.Error())
+      return
+   }
+   aTids := make(map[string]bool, len(aDir))
+   aMoved := false
+   for _, aFn := range aDir {
+      if strings.HasSuffix(aFn, ".bak") { continue }
+      if strings.HasSuffix(aFn, "_forward") {
+         var aFwd []tFwdEl
+         aBuf, err := ioutil.ReadFile(dirThread(o.svc) + aFn)
+         if err == nil {
+            err = json.Unmarshal(aBuf, &aFwd)
+         }
+         if err != nil { o.report("thread %s: %s", aFn, err.Error()) }
+         continue
+      }
+      if strings.ContainsRune(aFn[1:], '_') { // draft of reply
+         aBuf, err := ioutil.ReadFile(dirThread(o.svc) + aFn)
+         if err == nil {
+            _, err = _fsckMsgHead(aBuf)
+         }
+         if err != nil { o.report("draft %s: %s", aFn, err.Error()) }
+         continue
+      }
+      aTids[aFn] = true
+      if !_fsckThread(o, aFn) && iQuarantine {
+         err = os.MkdirAll(dirQuarantine(o.svc), 0700)
+         if err == nil {
+            err = os.Rename(dirThread(o.svc) + aFn, dirQuarantine(o.svc) + aFn)
+         }
+         if err == nil {
+            err = os.Rename(dirAttach(o.svc) + aFn, dirQuarantine(o.svc) + aFn + "_attach")
+            if os.IsNotExist(err) { err = nil }
+         }
+         if err != nil {
+            fmt.Printf("fsck %s: thread %s: quarantine failed: %s\n", o.svc, aFn, err.Error())
+            continue
+         }
+         fmt.Printf("fsck %s: thread %s: moved to %s\n", o.svc, aFn, dirQuarantine(o.svc))
+         aMoved = true
+      }
+   }
+   if aMoved {
+      err = os.RemoveAll(fileIndex(o.svc)) // rebuilt on startup without quarantined threads
+      if err != nil { o.report("%s", err.Error()) }
+   }
+   aDir, err = readDirNames(dirAttach(o.svc))
+   if err != nil {
+      if !os.IsNotExist(err) { o.report("%s", err.Error()) }
+      return
+   }
+   for _, aFn := range aDir {
+      if !aTids[aFn] && !strings.HasSuffix(aFn, ".tmp") {
+         o.report("attach %s: no such thread", aFn)
+      }
+   }
+}
+
+// returns false if thread should be quarantined
+func _fsckThread(o *tFsck, iTid string) bool {
+   aBuf, err := ioutil.ReadFile(dirThread(o.svc) + iTid)
+   if err != nil {
+      o.report("thread %s: %s", iTid, err.Error())
+      return false
+   }
+   aLen := int64(len(aBuf))
+   if aLen < 16 {
+      o.report("thread %s: file shorter than tail", iTid)
+      return false
+   }
+   aLenIdx, err := strconv.ParseUint(string(aBuf[aLen-16:aLen-8]), 16, 0)
+   if err == nil {
+      var aLenCc uint64
+      aLenCc, err = strconv.ParseUint(string(aBuf[aLen-8:]), 16, 0)
+      aLenIdx += aLenCc
+   }
+   if err != nil {
+      o.report("thread %s: invalid tail", iTid)
+      return false
+   }
+   aPos := aLen - 16 - int64(aLenIdx)
+   if aPos < 0 {
+      o.report("thread %s: tail lengths exceed file size", iTid)
+      return false
+   }
+   var aIdx []tIndexEl
+   var aCc []tCcEl
+   aDc := json.NewDecoder(strings.NewReader(string(aBuf[aPos:aLen-16])))
+   err = aDc.Decode(&aIdx)
+   if err == nil {
+      err = aDc.Decode(&aCc)
+   }
+   if err != nil {
+      o.report("thread %s: invalid index: %s", iTid, err.Error())
+      return false
+   }
+   aOk := true
+   for _, aEl := range aIdx {
+      if aEl.Offset == -1 { continue } // draft
+      if aEl.Offset < 0 || aEl.Size < 1 || aEl.Offset + aEl.Size > aPos {
+         o.report("thread %s: msg %s: outside message area", iTid, aEl.Id)
+         aOk = false
+         continue
+      }
+      aMsg := aBuf[aEl.Offset : aEl.Offset + aEl.Size]
+      if crc32.Checksum(aMsg[:len(aMsg)-1], kCrc32c) != aEl.Checksum || aMsg[len(aMsg)-1] != '\n' {
+         o.report("thread %s: msg %s: checksum mismatch", iTid, aEl.Id)
+         aOk = false
+         continue
+      }
+      aHead, err := _fsckMsgHead(aMsg)
+      if err != nil || aHead.Id != aEl.Id {
+         o.report("thread %s: msg %s: invalid header", iTid, aEl.Id)
+         aOk = false
+         continue
+      }
+      for _, aAtc := range aHead.SubHead.Attach {
+         if _isFormFill(aAtc.Name) { continue }
+         aFi, err := os.Stat(fileAtc(o.svc, iTid, aEl.Id, aAtc.Name))
+         if err != nil {
+            o.report("thread %s: msg %s: attachment %s: %s", iTid, aEl.Id, aAtc.Name, err.Error())
+         } else if aAtc.Size > 0 && aFi.Size() != aAtc.Size {
+            o.report("thread %s: msg %s: attachment %s: size %d, expected %d",
+                     iTid, aEl.Id, aAtc.Name, aFi.Size(), aAtc.Size)
+         }
+      }
+   }
+   return aOk
+}
+
+// like _readMsgHead() but returns error
+func _fsckMsgHead(iBuf []byte) (*tMsgHead, error) {
+   var aHead tMsgHead
+   if len(iBuf) < 4 {
+      return nil, tError("truncated header")
+   }
+   aLen, err := strconv.ParseUint(string(iBuf[:4]), 16, 0)
+   if err != nil || int(aLen) + 5 > len(iBuf) {
+      return nil, tError("invalid header length")
+   }
+   err = json.Unmarshal(iBuf[4:4+aLen], &aHead)
+   if err != nil {
+      return nil, err
+   }
+   return &aHead, nil
+}
+
+func _fsckForms(o *tFsck) {
+   aDir, err := readDirNames(dirForm(o.svc))
+   if err != nil {
+      if !os.IsNotExist(err) { o.report("%s", err.Error()) }
+      return
+   }
+   for _, aFn := range aDir {
+      if strings.HasSuffix(aFn, ".bak") { continue }
+      aBuf, err := ioutil.ReadFile(dirForm(o.svc) + aFn)
+      if err != nil {
+         o.report("form %s: %s", unescapeFile(aFn), err.Error())
+      } else if !json.Valid(aBuf) {
+         o.report("form %s: invalid json", unescapeFile(aFn))
+      }
+   }
+}
@@ -0,0 +1,472 @@
+// Copyright 2017, 2019 Liam Breck
+// Published at https://github.com/networkimprov/mnm-hammer
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/
+
+package slib
+
+import (
+   "bufio"
+   "bytes"
+   "encoding/base64"
+   "fmt"
+   "io"
+   "io/ioutil"
+   "mime"
+   "mime/multipart"
+   "mime/quotedprintable"
+   "net/mail"
+   "os"
+   "path"
+   "regexp"
+   "sort"
+   "strings"
+   "time"
+   "unicode/utf8"
+)
+
+const kImportTag = "Imported"
+const kImportSubjectMax = 512
+const kImportNameMax = 100
+const kImportNoteMsgs = 500 // progress notice interval
+
+var sImportRefRe = regexp.MustCompile(`<[^<>\s]+>`)
+var sImportReRe = regexp.MustCompile(`(?i)^\s*((re|fwd?|aw|sv)\s*(\[\d+\])?:\s*)+`)
+
+type tImportMsg struct {
+   path string // mbox or maildir file
+   pos, size int64 // in mbox; size -1 for whole file
+   key string // Message-ID
+   refs []string // References & In-Reply-To
+   date time.Time
+}
+
+type tImportParts struct {
+   text, html []byte
+   attach []tImportAtc
+}
+
+type tImportAtc struct {
+   name string
+   data []byte
+}
+
+// stores messages of mbox file or Maildir at iPath as threads of iSvc
+// returns count of threads added
+func ImportService(iSvc string, iPath string) (int, error) {
+   if getService(iSvc) == nil {
+      return 0, tError("service not found: "+ iSvc)
+   }
+   aTagId := GetIdTag(kImportTag)
+   if aTagId == "" {
+      aTagId = makeIdTag()
+      addTag(iSvc, kImportTag, aTagId) //todo sync to other nodes; no client state here
+   } else if mustCopyTag(iSvc, aTagId) != "" {
+      addTag(iSvc, kImportTag, aTagId)
+   }
+   return _storeAllImport(iSvc, iPath, aTagId, nil)
+}
+
+// runs thread_import in the background; posts progress in a notice named iName
+// the tag must already exist in iSvc
+func startImport(iSvc string, iPath string, iName string, iTagId string) {
+   aNoteId := fmt.Sprintf("import_%d", time.Now().UnixNano())
+   fNote := func(cBlurb string) {
+      setImportNotice(iSvc, aNoteId, "Import "+ iName, cBlurb)
+      sToAllFn([]string{"tl", "/v"})
+   }
+   fNote("started")
+   go func() {
+      aSvc := getService(iSvc)
+      aSvc.updt.RLock(); defer aSvc.updt.RUnlock()
+      defer func() {
+         if err := RecoverDamage(iSvc, recover()); err != nil {
+            fNote("failed: "+ err.Error())
+         }
+      }()
+      _, err := _storeAllImport(iSvc, iPath, iTagId, fNote)
+      if err != nil {
+         fmt.Fprintf(os.Stderr, "startImport %s: %s\n", iSvc, err)
+         fNote("failed: "+ err.Error())
+      }
+   }()
+}
+
+// stores the messages, tagging new threads with iTagId; iNote, if given, receives progress reports
+func _storeAllImport(iSvc string, iPath string, iTagId string, iNote func(string)) (int, error) {
+   aFi, err := os.Stat(iPath)
+   if err != nil { return 0, err }
+   var aMsgs []tImportMsg
+   if aFi.IsDir() {
+      aMsgs, err = _scanMaildirImport(iPath)
+   } else {
+      aMsgs, err = _scanMboxImport(iPath, aFi.ModTime())
+   }
+   if err != nil { return 0, err }
+   if len(aMsgs) == 0 {
+      return 0, tError("no messages found in "+ iPath)
+   }
+   aThreads, aStored, aFailed, aDone := 0, 0, 0, 0
+   aUsed := map[string]bool{}
+   for _, aSet := range _threadImport(aMsgs) {
+      aTid := ""
+      aSubject := ""
+      for a := range aSet {
+         aId := _makeIdImport(aSet[a].date, aUsed)
+         aKind, err := _storeImport(iSvc, &aSet[a], aId, aTid, &aSubject)
+         if err != nil {
+            fmt.Fprintf(os.Stderr, "ImportService %s: message %s: %s\n", iSvc, aSet[a].key, err)
+            aFailed++
+            continue // if thread not yet stored, next message starts it
+         }
+         if aTid == "" {
+            aTid = aId
+            if aKind == "thread" {
+               aThreads++
+               touchThread(iSvc, &Update{Touch: &UpdateTouch{ThreadId: aTid, MsgId: aTid, TagId: iTagId,
+                                                             Act: 't'}})
+            }
+         }
+         if aKind != "" { aStored++ }
+      }
+      aDone += len(aSet)
+      if iNote != nil && aDone / kImportNoteMsgs != (aDone - len(aSet)) / kImportNoteMsgs {
+         iNote(fmt.Sprintf("%d of %d messages", aDone, len(aMsgs)))
+      }
+   }
+   //todo replicate imported threads to other nodes
+   aResult := fmt.Sprintf("%d threads, %d messages stored; %d failed, %d already stored",
+                          aThreads, aStored, aFailed, len(aMsgs) - aStored - aFailed)
+   fmt.Printf("ImportService %s: %s from %s\n", iSvc, aResult, iPath)
+   if iNote != nil {
+      iNote(aResult)
+   }
+   return aThreads, nil
+}
+
+func _scanMboxImport(iPath string, iMtime time.Time) ([]tImportMsg, error) {
+   aFd, err := os.Open(iPath)
+   if err != nil { return nil, err }
+   defer aFd.Close()
+   aRd := bufio.NewReader(aFd)
+   var aMsgs []tImportMsg
+   var aHead bytes.Buffer
+   var aPos, aEnd int64
+   aInHead, aPrevBlank := false, true
+   fEnd := func() {
+      cMsg := &aMsgs[len(aMsgs)-1]
+      cMsg.size = aEnd - cMsg.pos
+      _headImport(cMsg, aHead.Bytes(), iMtime)
+   }
+   for {
+      aLine, err := aRd.ReadBytes('\n')
+      if len(aLine) > 0 {
+         aBlank := len(bytes.TrimRight(aLine, "\r\n")) == 0
+         if aPrevBlank && bytes.HasPrefix(aLine, []byte("From ")) {
+            if len(aMsgs) > 0 { fEnd() }
+            aMsgs = append(aMsgs, tImportMsg{path: iPath, pos: aPos + int64(len(aLine))})
+            aHead.Reset()
+            aInHead = true
+         } else if aInHead {
+            aInHead = !aBlank
+            aHead.Write(aLine)
+         }
+         aPos += int64(len(aLine))
+         if !aBlank { aEnd = aPos }
+         aPrevBlank = aBlank
+      }
+      if err == io.EOF { break }
+      if err != nil { return nil, err }
+   }
+   if len(aMsgs) > 0 {
+      fEnd()
+   } else if aPos > 0 {
+      return nil, tError("not an mbox file: "+ iPath)
+   }
+   return aMsgs, nil
+}
+
+func _scanMaildirImport(iPath string) ([]tImportMsg, error) {
+   var aMsgs []tImportMsg
+   for _, aSub := range [...]string{"/cur/", "/new/"} {
+      aDir, err := readDirFis(iPath + aSub)
+      if err != nil {
+         if os.IsNotExist(err) { continue }
+         return nil, err
+      }
+      for _, aFi := range aDir {
+         if aFi.IsDir() || aFi.Name()[0] == '.' { continue }
+         aMsg := tImportMsg{path: iPath + aSub + aFi.Name(), size: -1}
+         aFd, err := os.Open(aMsg.path)
+         if err != nil { return nil, err }
+         var aHead bytes.Buffer
+         aRd := bufio.NewReader(aFd)
+         for {
+            aLine, err := aRd.ReadBytes('\n')
+            aHead.Write(aLine)
+            if err != nil || len(bytes.TrimRight(aLine, "\r\n")) == 0 { break }
+         }
+         aFd.Close()
+         _headImport(&aMsg, aHead.Bytes(), aFi.ModTime())
+         aMsgs = append(aMsgs, aMsg)
+      }
+   }
+   if aMsgs == nil {
+      return nil, tError("not a Maildir: "+ iPath)
+   }
+   return aMsgs, nil
+}
+
+func _headImport(iMsg *tImportMsg, iHead []byte, iDate time.Time) {
+   iMsg.date = iDate
+   aMsg, err := mail.ReadMessage(bytes.NewReader(append(iHead, "\r\n"...)))
+   if err != nil {
+      return
+   }
+   if aRefs := sImportRefRe.FindAllString(aMsg.Header.Get("Message-Id"), 1); len(aRefs) > 0 {
+      iMsg.key = aRefs[0]
+   }
+   iMsg.refs = sImportRefRe.FindAllString(aMsg.Header.Get("References") +" "+
+                                          aMsg.Header.Get("In-Reply-To"), -1)
+   aDate, err := aMsg.Header.Date()
+   if err == nil {
+      iMsg.date = aDate
+   }
+}
+
+// groups messages by references; each set is sorted by date
+func _threadImport(iMsgs []tImportMsg) [][]tImportMsg {
+   aRoot := map[string]string{}
+   fFind := func(c string) string {
+      for aRoot[c] != "" && aRoot[c] != c { c = aRoot[c] }
+      return c
+   }
+   aKeys := map[string]bool{}
+   for a := range iMsgs {
+      if iMsgs[a].key == "" || aKeys[iMsgs[a].key] {
+         iMsgs[a].key = fmt.Sprintf("<%d@import>", a) // missing or duplicate id
+      }
+      aKeys[iMsgs[a].key] = true
+      aMine := fFind(iMsgs[a].key)
+      for _, aRef := range iMsgs[a].refs {
+         if aR := fFind(aRef); aR != aMine {
+            aRoot[aR] = aMine
+         }
+      }
+   }
+   aSetIdx := map[string]int{}
+   var aSets [][]tImportMsg
+   for a := range iMsgs {
+      aR := fFind(iMsgs[a].key)
+      if _, ok := aSetIdx[aR]; !ok {
+         aSetIdx[aR] = len(aSets)
+         aSets = append(aSets, nil)
+      }
+      aSets[aSetIdx[aR]] = append(aSets[aSetIdx[aR]], iMsgs[a])
+   }
+   for _, aSet := range aSets {
+      sort.SliceStable(aSet, func(cA, cB int) bool { return aSet[cA].date.Before(aSet[cB].date) })
+   }
+   return aSets
+}
+
+// returns an id ordered by date, so re-importing yields the same ids
+func _makeIdImport(iDate time.Time, iUsed map[string]bool) string {
+   aN := iDate.UnixNano()
+   if aN < 0 { aN = 0 }
+   aId := fmt.Sprintf("%016x", aN)
+   for iUsed[aId] {
+      aN++
+      aId = fmt.Sprintf("%016x", aN)
+   }
+   iUsed[aId] = true
+   return aId
+}
+
+// stores message as iId in thread iTid, or a new thread if iTid is empty
+func _storeImport(iSvc string, iMsg *tImportMsg, iId, iTid string, iSubject *string) (string, error) {
+   var err error
+   var aRaw []byte
+   if iMsg.size < 0 {
+      aRaw, err = ioutil.ReadFile(iMsg.path)
+   } else {
+      var aFd *os.File
+      aFd, err = os.Open(iMsg.path)
+      if err != nil { return "", err }
+      aRaw = make([]byte, iMsg.size)
+      _, err = aFd.ReadAt(aRaw, iMsg.pos)
+      aFd.Close()
+      aRaw = _unescapeMboxImport(aRaw)
+   }
+   if err != nil { return "", err }
+   aMsg, err := mail.ReadMessage(bytes.NewReader(aRaw))
+   if err != nil { return "", err }
+
+   var aParts tImportParts
+   err = _partImport(aMsg.Header.Get("Content-Type"), aMsg.Header.Get("Content-Transfer-Encoding"),
+                     "", aMsg.Body, &aParts)
+   if err != nil { return "", err }
+
+   var aBody bytes.Buffer
+   for _, aField := range [...]string{"From", "To", "Cc", "Date"} {
+      if aVal := _decodeImport(aMsg.Header.Get(aField)); aVal != "" {
+         fmt.Fprintf(&aBody, "%s: %s  \n", aField, aVal)
+      }
+   }
+   aBody.WriteString("\n")
+   if aParts.text != nil {
+      aBody.Write(bytes.TrimRight(aParts.text, " \t\r\n"))
+   } else if aParts.html != nil {
+      aBody.WriteString("_HTML message attached_")
+      aParts.attach = append([]tImportAtc{{name: "message.html", data: aParts.html}}, aParts.attach...)
+   }
+   aBody.WriteString("\n")
+
+   aFrom, aAlias := "unknown", ""
+   if aAdr, err := mail.ParseAddress(_decodeImport(aMsg.Header.Get("From"))); err == nil {
+      aFrom, aAlias = strings.ToLower(aAdr.Address), aAdr.Name
+   } else if aVal := strings.TrimSpace(aMsg.Header.Get("From")); aVal != "" {
+      aFrom = aVal
+   }
+   if aAlias == "" { aAlias = aFrom }
+   aSubject := _truncImport(_decodeImport(aMsg.Header.Get("Subject")), kImportSubjectMax)
+   if iTid == "" {
+      *iSubject = aSubject
+   } else if sImportReRe.ReplaceAllString(aSubject, "") == sImportReRe.ReplaceAllString(*iSubject, "") {
+      aSubject = "" // same as thread
+   }
+   aHead := &Header{Id: iId, From: aFrom, Posted: iMsg.date.UTC().Format(time.RFC3339),
+                    SubHead: &tHeader2{ThreadId: iTid, Alias: aAlias, Subject: aSubject, imported: true}}
+   aRds := []io.Reader{&aBody}
+   aNames := map[string]bool{}
+   for _, aAtc := range aParts.attach {
+      aName := _nameImport(aAtc.name, aNames)
+      aHead.SubHead.Attach = append(aHead.SubHead.Attach,
+                                    tHeader2Attach{Name: "u:"+ aName, Size: int64(len(aAtc.data))})
+      aRds = append(aRds, bytes.NewReader(aAtc.data))
+   }
+   aHead.DataLen = int64(aBody.Len()) + totalAttach(aHead.SubHead)
+   return storeReceivedThread(iSvc, aHead, io.MultiReader(aRds...))
+}
+
+// collects text, html and attachments from a message or part
+func _partImport(iType, iEnc, iDisp string, iR io.Reader, iParts *tImportParts) error {
+   aMedia, aParams, err := mime.ParseMediaType(iType)
+   if err != nil {
+      aMedia, aParams = "text/plain", map[string]string{}
+   }
+   if strings.HasPrefix(aMedia, "multipart/") {
+      aMr := multipart.NewReader(iR, aParams["boundary"])
+      for {
+         aPart, err := aMr.NextPart() // decodes quoted-printable
+         if err == io.EOF { return nil }
+         if err != nil { return err }
+         err = _partImport(aPart.Header.Get("Content-Type"), aPart.Header.Get("Content-Transfer-Encoding"),
+                           aPart.Header.Get("Content-Disposition"), aPart, iParts)
+         if err != nil { return err }
+      }
+   }
+   switch strings.ToLower(strings.TrimSpace(iEnc)) {
+   case "base64":
+      iR = base64.NewDecoder(base64.StdEncoding, iR)
+   case "quoted-printable":
+      iR = quotedprintable.NewReader(iR)
+   }
+   aData, err := ioutil.ReadAll(iR)
+   if err != nil { return err }
+
+   aName := aParams["name"]
+   aDisp, aDispParams, err := mime.ParseMediaType(iDisp)
+   if err == nil && aDispParams["filename"] != "" {
+      aName = aDispParams["filename"]
+   }
+   aName = _decodeImport(aName)
+   if aDisp != "attachment" && aName == "" {
+      if aMedia == "text/plain" && iParts.text == nil {
+         iParts.text = _utf8Import(aData, aParams["charset"])
+         return nil
+      }
+      if aMedia == "text/html" && iParts.html == nil {
+         iParts.html = _utf8Import(aData, aParams["charset"])
+         return nil
+      }
+   }
+   if aName == "" {
+      aName = "part"
+      if aMedia == "message/rfc822" {
+         aName += ".eml"
+      } else if aExt, _ := mime.ExtensionsByType(aMedia); len(aExt) > 0 {
+         aName += aExt[0]
+      }
+   }
+   iParts.attach = append(iParts.attach, tImportAtc{name: aName, data: aData})
+   return nil
+}
+
+// returns a unique, storable attachment name
+func _nameImport(iName string, iUsed map[string]bool) string {
+   iName = strings.TrimSpace(path.Base(strings.ReplaceAll(iName, "\\", "/")))
+   if iName == "" || iName == "." || iName == "/" { iName = "part" }
+   aExt := path.Ext(iName)
+   if len(aExt) > 16 { aExt = "" }
+   aBase := _truncImport(strings.TrimSuffix(iName, aExt), kImportNameMax)
+   iName = aBase + aExt
+   for a := 2; iUsed[iName]; a++ {
+      iName = fmt.Sprintf("%s-%d%s", aBase, a, aExt)
+   }
+   iUsed[iName] = true
+   return iName
+}
+
+// drops the '>' added to /^>+From / lines by mboxrd
+func _unescapeMboxImport(iMsg []byte) []byte {
+   if !bytes.Contains(iMsg, []byte(">From ")) {
+      return iMsg
+   }
+   var aBuf bytes.Buffer
+   for _, aLine := range bytes.SplitAfter(iMsg, []byte{'\n'}) {
+      if bytes.HasPrefix(bytes.TrimLeft(aLine, ">"), []byte("From ")) && aLine[0] == '>' {
+         aLine = aLine[1:]
+      }
+      aBuf.Write(aLine)
+   }
+   return aBuf.Bytes()
+}
+
+func _decodeImport(iVal string) string {
+   aDec := mime.WordDecoder{CharsetReader: _charsetImport}
+   aOut, err := aDec.DecodeHeader(iVal)
+   if err != nil {
+      aOut = iVal
+   }
+   return strings.ToValidUTF8(strings.TrimSpace(aOut), "\uFFFD")
+}
+
+func _charsetImport(iCharset string, iR io.Reader) (io.Reader, error) {
+   aData, err := ioutil.ReadAll(iR)
+   if err != nil { return nil, err }
+   return bytes.NewReader(_utf8Import(aData, iCharset)), nil
+}
+
+// converts latin-1 text; other charsets are assumed to be utf-8
+func _utf8Import(iData []byte, iCharset string) []byte {
+   switch strings.ToLower(iCharset) {
+   case "iso-8859-1", "latin1", "windows-1252", "cp1252":
+      aBuf := make([]byte, 0, len(iData))
+      for _, aB := range iData {
+         aBuf = append(aBuf, string(rune(aB))...)
+      }
+      return aBuf
+   }
+   return bytes.ToValidUTF8(iData, []byte("\uFFFD"))
+}
+
+func _truncImport(iStr string, iMax int) string {
+   if len(iStr) <= iMax {
+      return iStr
+   }
+   for iMax > 0 && !utf8.RuneStart(iStr[iMax]) { iMax-- }
+   return iStr[:iMax]
+}
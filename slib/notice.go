@@ -48,6 +48,22 @@ func addPingNotice(iSvc string, iMsgId string, iAlias, iGid string, iBlurb strin
    if err != nil { quit(err) }
 }
 
+// adds or replaces the notice iMsgId, which reports the progress of an import
+func setImportNotice(iSvc string, iMsgId string, iName string, iBlurb string) {
+   aSvc := getService(iSvc)
+   aSvc.Lock(); defer aSvc.Unlock()
+   for a := range aSvc.notice {
+      if aSvc.notice[a].MsgId == iMsgId {
+         aSvc.notice = aSvc.notice[:a + copy(aSvc.notice[a:], aSvc.notice[a+1:])]
+         break
+      }
+   }
+   aEl := tNoticeEl{Type:"m", MsgId:iMsgId, Date:dateRFC3339(), Alias:iName, Blurb:iBlurb}
+   aSvc.notice = append(aSvc.notice, aEl)
+   err := storeFile(fileNotc(iSvc), aSvc.notice)
+   if err != nil { quit(err) }
+}
+
 func setLastSeenNotice(iSvc string, iUpdt *Update) error {
    if iUpdt.Notice.MsgId == "" {
       return tError("msgid missing")
@@ -8,19 +8,97 @@
 package slib
 
 import (
+   "math/rand"
    "sort"
+   "strings"
+   "time"
 )
 
+const kQueueTriesMax = 8
+const kQueueDueMin = time.Second
+const kQueueRetryWaitMax = 2 * 60 // seconds
+
+type QueueTry int8 // result of TryQueue()
+const ( QueueRetry QueueTry = iota; QueueFailed; QueueDropped )
+
 type tQueueEl struct {
   Srec SendRecord
   Date string
+  Tries int `json:",omitempty"`
+  Error string `json:",omitempty"` // last send error
+  Failed bool `json:",omitempty"` // not resent until retryQueue()
+  Due string `json:",omitempty"` // not posted until this date; cleared when posted
+  Hold bool `json:",omitempty"` // Due is end of undo period, draft not editable
+  Retry bool `json:",omitempty"` // Due is resend after a failed try
+  sending bool // written to server, awaiting ack
+}
+
+var kQueueType = map[byte]string{
+   eSrecThread: "thread", eSrecFwd: "forward", eSrecCfm: "confirm",
+   eSrecPing: "ping", eSrecOhi: "ohi", eSrecAccept: "accept",
+   eSrecAlias: "alias", eSrecNode: "node", eSrecSync: "sync",
+}
+
+func GetIdxQueue(iSvc string) interface{} {
+   type tQueueElOut struct {
+      Id string
+      Type string
+      Date string
+      ThreadId string `json:",omitempty"`
+      Tries int `json:",omitempty"`
+      Error string `json:",omitempty"`
+      Failed bool `json:",omitempty"`
+      Sending bool `json:",omitempty"`
+      Due string `json:",omitempty"`
+      Hold bool `json:",omitempty"`
+      Retry bool `json:",omitempty"`
+   }
+   aSvc := getService(iSvc)
+   aSvc.RLock()
+   aList := make([]tQueueElOut, len(aSvc.sendQ))
+   for a, aEl := range aSvc.sendQ {
+      aList[a] = tQueueElOut{Id:aEl.Srec.Id, Type:kQueueType[aEl.Srec.Id[0]], Date:aEl.Date,
+                             Tries:aEl.Tries, Error:aEl.Error, Failed:aEl.Failed, Sending:aEl.sending,
+                             Due:aEl.Due, Hold:aEl.Hold, Retry:aEl.Retry}
+      switch aEl.Srec.Id[0] {
+      case eSrecThread, eSrecFwd:
+         aList[a].ThreadId = parseLocalId(aEl.Srec.Id[1:]).tid()
+         if aList[a].ThreadId == "" { aList[a].ThreadId = aEl.Srec.Id[1:] } // new thread
+      case eSrecCfm:
+         aList[a].ThreadId = aEl.Srec.Id[1:strings.IndexByte(aEl.Srec.Id, '_')]
+      }
+   }
+   aSvc.RUnlock()
+   sort.SliceStable(aList, func(cA, cB int) bool { return aList[cA].Date < aList[cB].Date })
+   return aList
 }
 
 func GetQueue(iSvc string, iPostFn func(...*SendRecord)) []*SendRecord {
    // assume we're called once during synchronous Init()
    aSvc := getService(iSvc)
    aSvc.sendQPost = iPostFn // do not call during Init()
-   aSort := append([]*tQueueEl{}, aSvc.sendQ...)
+   aSort := make([]*tQueueEl, 0, len(aSvc.sendQ))
+   aNow := time.Now().UTC()
+   aDueSoon := aNow.Add(kQueueDueMin).Format(time.RFC3339)
+   aRelease := false
+   for _, aEl := range aSvc.sendQ {
+      if aEl.Failed {
+         continue
+      }
+      if aEl.Due > aDueSoon {
+         _scheduleQueue(iSvc, aEl, aNow)
+         continue
+      }
+      if aEl.Due != "" {
+         aEl.Due, aEl.Hold, aEl.Retry = "", false, false
+         aRelease = true
+      }
+      aSort = append(aSort, aEl)
+   }
+   if aRelease {
+      err := storeFile(fileSendq(iSvc), aSvc.sendQ)
+      if err != nil { quit(err) }
+   }
    sort.Slice(aSort, func(cA, cB int) bool { return aSort[cA].Date < aSort[cB].Date })
    aQ := make([]*SendRecord, len(aSort))
    for a := range aSort {
@@ -29,31 +107,200 @@ func GetQueue(iSvc string, iPostFn func(...*SendRecord)) []*SendRecord {
    return aQ
 }
 
+// starts timer to post record when due; timer may be superseded by a later one
+func _scheduleQueue(iSvc string, iEl *tQueueEl, iNow time.Time) {
+   aDue, err := time.Parse(time.RFC3339, iEl.Due)
+   if err != nil { quit(err) }
+   aWait := aDue.Sub(iNow); if aWait < kQueueDueMin { aWait = kQueueDueMin }
+   aId := iEl.Srec.Id
+   time.AfterFunc(aWait, func() {
+      aSvc := getService(iSvc)
+      aSvc.Lock(); defer aSvc.Unlock()
+      aEl := sort.Search(len(aSvc.sendQ), func(c int) bool { return aSvc.sendQ[c].Srec.Id >= aId })
+      if aEl == len(aSvc.sendQ) || aSvc.sendQ[aEl].Srec.Id != aId {
+         return // cancelled or sent
+      }
+      aQel := aSvc.sendQ[aEl]
+      if aQel.Due == "" || aQel.Due > dateRFC3339() {
+         return // posted or rescheduled
+      }
+      aQel.Due, aQel.Hold, aQel.Retry = "", false, false
+      err := storeFile(fileSendq(iSvc), aSvc.sendQ)
+      if err != nil { quit(err) }
+      if aSvc.sendQPost != nil {
+         aSvc.sendQPost(&aQel.Srec)
+      }
+   })
+}
+
+// returns send date if record is scheduled or held
+func dueQueue(iSvc string, iType byte, iId string) string {
+   aSvc := getService(iSvc)
+   aSvc.RLock(); defer aSvc.RUnlock()
+   aId := string(iType) + iId
+   aEl := sort.Search(len(aSvc.sendQ), func(c int) bool { return aSvc.sendQ[c].Srec.Id >= aId })
+   if aEl < len(aSvc.sendQ) && aSvc.sendQ[aEl].Srec.Id == aId && !aSvc.sendQ[aEl].Retry {
+      return aSvc.sendQ[aEl].Due
+   }
+   return ""
+}
+
+// checks optional date for scheduled send; returns it in UTC
+func checkDueQueue(iUpdt *Update) (string, error) {
+   if iUpdt.Queue == nil || iUpdt.Queue.Due == "" {
+      return "", nil
+   }
+   aDue, err := time.Parse(time.RFC3339, iUpdt.Queue.Due)
+   if err != nil {
+      return "", tError("send date not RFC3339")
+   }
+   if aDue.After(time.Now().AddDate(1, 0, 0)) {
+      return "", tError("send date more than a year ahead")
+   }
+   return aDue.UTC().Format(time.RFC3339), nil
+}
+
 func hasQueue(iSvc string, iType byte, iId string) bool {
    aSvc := getService(iSvc)
    aSvc.RLock(); defer aSvc.RUnlock()
    aId := string(iType) + iId
    aEl := sort.Search(len(aSvc.sendQ), func(c int) bool { return aSvc.sendQ[c].Srec.Id >= aId })
-   return aEl < len(aSvc.sendQ) && aSvc.sendQ[aEl].Srec.Id == aId
+   return aEl < len(aSvc.sendQ) && aSvc.sendQ[aEl].Srec.Id == aId &&
+          (aSvc.sendQ[aEl].Due == "" || aSvc.sendQ[aEl].Hold || aSvc.sendQ[aEl].Retry)
+}
+
+// returns last error if record has failed
+func failedQueue(iSvc string, iType byte, iId string) string {
+   aSvc := getService(iSvc)
+   aSvc.RLock(); defer aSvc.RUnlock()
+   aId := string(iType) + iId
+   aEl := sort.Search(len(aSvc.sendQ), func(c int) bool { return aSvc.sendQ[c].Srec.Id >= aId })
+   if aEl < len(aSvc.sendQ) && aSvc.sendQ[aEl].Srec.Id == aId && aSvc.sendQ[aEl].Failed {
+      return aSvc.sendQ[aEl].Error
+   }
+   return ""
+}
+
+// records a failed attempt; returns tries so far and whether the record is scheduled for resend
+// a permanent error, e.g. a damaged draft, fails the record without further tries
+// resends back off exponentially, with jitter, to kQueueRetryWaitMax
+func TryQueue(iSvc string, iSrec *SendRecord, iErr string, iPermanent bool) (int, QueueTry) {
+   aSvc := getService(iSvc)
+   aSvc.Lock(); defer aSvc.Unlock()
+   aEl := sort.Search(len(aSvc.sendQ), func(c int) bool { return aSvc.sendQ[c].Srec.Id >= iSrec.Id })
+   if aEl == len(aSvc.sendQ) || aSvc.sendQ[aEl].Srec.Id != iSrec.Id {
+      return 0, QueueDropped // cancelled or acked meanwhile
+   }
+   aQel := aSvc.sendQ[aEl]
+   aQel.sending = false
+   aQel.Tries++
+   aQel.Error = iErr
+   aQel.Failed = iPermanent || aQel.Tries >= kQueueTriesMax
+   aNow := time.Now().UTC()
+   if !aQel.Failed {
+      aWait := 1 << uint(aQel.Tries-1) // seconds
+      if aWait > kQueueRetryWaitMax { aWait = kQueueRetryWaitMax }
+      aWait += rand.Intn(aWait / 2 + 1)
+      aQel.Due = aNow.Add(time.Duration(aWait) * time.Second).Format(time.RFC3339)
+      aQel.Retry = true
+   }
+   err := storeFile(fileSendq(iSvc), aSvc.sendQ)
+   if err != nil { quit(err) }
+   if aQel.Failed {
+      return aQel.Tries, QueueFailed
+   }
+   _scheduleQueue(iSvc, aQel, aNow)
+   return aQel.Tries, QueueRetry
+}
+
+func retryQueue(iSvc string, iId string) error {
+   aSvc := getService(iSvc)
+   aSvc.Lock(); defer aSvc.Unlock()
+   aEl := sort.Search(len(aSvc.sendQ), func(c int) bool { return aSvc.sendQ[c].Srec.Id >= iId })
+   if aEl == len(aSvc.sendQ) || aSvc.sendQ[aEl].Srec.Id != iId || !aSvc.sendQ[aEl].Failed {
+      return tError("not a failed record")
+   }
+   aQel := aSvc.sendQ[aEl]
+   aQel.Tries, aQel.Error, aQel.Failed = 0, "", false
+   err := storeFile(fileSendq(iSvc), aSvc.sendQ)
+   if err != nil { quit(err) }
+   if aSvc.sendQPost != nil {
+      aSvc.sendQPost(&aQel.Srec)
+   }
+   return nil
+}
+
+// drops a record not yet sent to the server, leaving its draft in place
+func cancelQueue(iSvc string, iId string) error {
+   switch iId[0] {
+   case eSrecSync, eSrecNode, eSrecAlias:
+      return tError("cannot cancel record of this type")
+   }
+   aSvc := getService(iSvc)
+   aSvc.Lock(); defer aSvc.Unlock()
+   aEl := sort.Search(len(aSvc.sendQ), func(c int) bool { return aSvc.sendQ[c].Srec.Id >= iId })
+   if aEl == len(aSvc.sendQ) || aSvc.sendQ[aEl].Srec.Id != iId {
+      return tError("not queued")
+   }
+   if aSvc.sendQ[aEl].sending {
+      return tError("already sent to server")
+   }
+   aSvc.sendQ = aSvc.sendQ[:aEl + copy(aSvc.sendQ[aEl:], aSvc.sendQ[aEl+1:])]
+   err := storeFile(fileSendq(iSvc), aSvc.sendQ)
+   if err != nil { quit(err) }
+   return nil
+}
+
+// marks record in flight; false if it was cancelled
+func sendingQueue(iSvc string, iId string) bool {
+   aSvc := getService(iSvc)
+   aSvc.Lock(); defer aSvc.Unlock()
+   aEl := sort.Search(len(aSvc.sendQ), func(c int) bool { return aSvc.sendQ[c].Srec.Id >= iId })
+   if aEl == len(aSvc.sendQ) || aSvc.sendQ[aEl].Srec.Id != iId {
+      return false
+   }
+   aSvc.sendQ[aEl].sending = true
+   return true
 }
 
 func addQueue(iSvc string, iType byte, iId string) {
+   addDueQueue(iSvc, iType, iId, "", false)
+}
+
+// holds record for iSecs before posting, so it may be cancelled
+func addHoldQueue(iSvc string, iType byte, iId string, iSecs int) {
+   aDue := time.Now().UTC().Add(time.Duration(iSecs) * time.Second).Format(time.RFC3339)
+   addDueQueue(iSvc, iType, iId, aDue, true)
+}
+
+// iDue is from checkDueQueue(); if a record is scheduled, reschedules it
+func addDueQueue(iSvc string, iType byte, iId string, iDue string, iHold bool) {
    aSvc := getService(iSvc)
    aSvc.Lock(); defer aSvc.Unlock()
    aId := string(iType) + iId
+   aNow := time.Now().UTC()
+   if iDue != "" && iDue <= aNow.Format(time.RFC3339) {
+      iDue = ""
+   }
+   if iDue == "" {
+      iHold = false
+   }
    aEl := sort.Search(len(aSvc.sendQ), func(c int) bool { return aSvc.sendQ[c].Srec.Id >= aId })
    if aEl < len(aSvc.sendQ) && aSvc.sendQ[aEl].Srec.Id == aId {
-      return
-   }
-   aSvc.sendQ = append(aSvc.sendQ, &tQueueEl{})
-   if aEl < len(aSvc.sendQ) {
+      if aSvc.sendQ[aEl].Due == "" {
+         return
+      }
+      aSvc.sendQ[aEl].Due, aSvc.sendQ[aEl].Hold, aSvc.sendQ[aEl].Retry = iDue, iHold, false
+   } else {
+      aSvc.sendQ = append(aSvc.sendQ, nil)
       copy(aSvc.sendQ[aEl+1:], aSvc.sendQ[aEl:])
+      aSvc.sendQ[aEl] = &tQueueEl{Srec:SendRecord{aId}, Date:dateRFC3339(), Due:iDue, Hold:iHold}
    }
-   aSvc.sendQ[aEl].Srec = SendRecord{aId}
-   aSvc.sendQ[aEl].Date = dateRFC3339()
    err := storeFile(fileSendq(iSvc), aSvc.sendQ)
    if err != nil { quit(err) }
-   if aSvc.sendQPost != nil {
+   if iDue != "" {
+      _scheduleQueue(iSvc, aSvc.sendQ[aEl], aNow)
+   } else if aSvc.sendQPost != nil {
       aSvc.sendQPost(&aSvc.sendQ[aEl].Srec)
    }
 }
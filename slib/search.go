@@ -10,23 +10,56 @@ package slib
 import (
    "bytes"
    "fmt"
+   "html"
    "io"
    "io/ioutil"
    "encoding/json"
    "os"
    "sort"
+   "strconv"
    "strings"
+   "sync/atomic"
+   "time"
+   "unicode/utf8"
 
    pBkeyword  "github.com/blevesearch/bleve/analysis/analyzer/keyword"
+   _          "github.com/blevesearch/bleve/analysis/analyzer/standard"
+   _          "github.com/blevesearch/bleve/analysis/lang/cjk"
+   _          "github.com/blevesearch/bleve/analysis/lang/da"
+   _          "github.com/blevesearch/bleve/analysis/lang/de"
+   _          "github.com/blevesearch/bleve/analysis/lang/en"
+   _          "github.com/blevesearch/bleve/analysis/lang/es"
+   _          "github.com/blevesearch/bleve/analysis/lang/fi"
+   _          "github.com/blevesearch/bleve/analysis/lang/fr"
+   _          "github.com/blevesearch/bleve/analysis/lang/it"
+   _          "github.com/blevesearch/bleve/analysis/lang/nl"
+   _          "github.com/blevesearch/bleve/analysis/lang/no"
+   _          "github.com/blevesearch/bleve/analysis/lang/pt"
+   _          "github.com/blevesearch/bleve/analysis/lang/ru"
+   _          "github.com/blevesearch/bleve/analysis/lang/sv"
    pBleve     "github.com/blevesearch/bleve"
    pBquery    "github.com/blevesearch/bleve/search/query"
    pBscorch   "github.com/blevesearch/bleve/index/scorch"
    pBsearch   "github.com/blevesearch/bleve/search"
 )
 
-var kSearchIndexRev = []byte("0.8")
+var kSearchIndexRev = []byte("0.11")
+
+const kSearchAnalyzerDefault = "en"
+var kSearchAnalyzers = map[string]bool{ // tSvcConfig.Analyzer; cjk for Chinese, Japanese, Korean
+   "en":true, "de":true, "fr":true, "es":true, "it":true, "pt":true, "nl":true,
+   "da":true, "no":true, "sv":true, "fi":true, "ru":true, "cjk":true, "standard":true}
+
+var sSearchLimit = 100 // results per page
+
+const kSnippetMax = 3 // excerpts per thread
+const kSnippetContext = 40 // bytes around a term
+const kSnippetLenMax = 240
+
+func SetLimitSearch(iLimit int) { if iLimit > 0 { sSearchLimit = iLimit } }
 
 type tSearchEl struct {
+   Svc string `json:",omitempty"` // for global search
    Id string
    Count uint32
    Subject string
@@ -35,6 +68,29 @@ type tSearchEl struct {
    OrigDate, LastDate string
    OrigAuthor, LastAuthor string
    Unread bool `json:",omitempty"`
+   SubjectSnippet string `json:",omitempty"` // html with terms in <mark>
+   Snippets []string `json:",omitempty"` // html excerpts of message text
+   MatchIds []string `json:",omitempty"` // messages with terms in text
+}
+
+type tSearchPage struct {
+   Total uint64
+   Offset, Limit int
+   List []tSearchEl
+}
+
+var kSearchSortDefault = "LastDate"
+var kSearchSorts = map[string]pBsearch.SortOrder{
+   "LastDate": {&pBsearch.SortField{Field:"LastTime", Type:pBsearch.SortFieldAsDate, Desc:true},
+                &pBsearch.SortDocID{Desc:true}},
+   "OrigDate": {&pBsearch.SortField{Field:"OrigTime", Type:pBsearch.SortFieldAsDate, Desc:true},
+                &pBsearch.SortDocID{Desc:true}},
+   "Count":    {&pBsearch.SortField{Field:"Count", Type:pBsearch.SortFieldAsNumber, Desc:true},
+                &pBsearch.SortField{Field:"LastTime", Type:pBsearch.SortFieldAsDate, Desc:true},
+                &pBsearch.SortDocID{Desc:true}},
+   "Subject":  {&pBsearch.SortField{Field:"SubjectKey", Type:pBsearch.SortFieldAsString},
+                &pBsearch.SortField{Field:"LastTime", Type:pBsearch.SortFieldAsDate, Desc:true},
+                &pBsearch.SortDocID{Desc:true}},
 }
 
 type tSearchDoc struct {
@@ -44,10 +100,14 @@ type tSearchDoc struct {
    Author tStrings // excludes self
    Tag tStrings
    OrigCc tStrings
+   Cc tStrings // current
    OrigAuthor, LastAuthor string
    OrigDate, LastDate string
    LastSubjectN int // ref to Subject item
+   SubjectKey string // for sort
    Unread bool
+   Attach bool
+   Attachment tStrings // file names & text
    Body string
    bodyStream io.Reader
 }
@@ -65,10 +125,24 @@ func (o *tStrings) addUnique(i string) {
    *o = append(*o, i)
 }
 
+const kSearchAttachKey = "attach:" // prefix of internal key for thread id
+
+type tAttachText struct { // attachment text by file name
+   Size int64
+   Mtime int64 // UnixNano
+   Text string
+}
+
 type tIndexer interface {
    Index(string, interface{}) error
 }
 
+// tReindex is the tIndexer of a new index; it reuses attachment text from the prior index
+type tReindex struct {
+   *pBleve.Batch
+   prior pBleve.Index // may be nil
+}
+
 var kResultFields = []string{"*"} //todo list fields?
 
 func WriteResultSearch(iW io.Writer, iSvc string, iState *ClientState) error {
@@ -97,43 +171,190 @@ func WriteResultSearch(iW io.Writer, iSvc string, iState *ClientState) error {
       aQb.SetField("Unread")
       aQ = aQb
    }
+   aPage := tSearchPage{Limit: sSearchLimit, List: []tSearchEl{}}
    if aQ == nil {
-      _, err = iW.Write([]byte{'[',']'})
+      err = json.NewEncoder(iW).Encode(aPage)
       return err
    }
-   aBi := getService(iSvc).index
-   aSr := pBleve.NewSearchRequestOptions(aQ, 1024, 0, false)
-   aSr.Fields = kResultFields
-   aSet, err := aBi.Search(aSr)
-   if err != nil { quit(err) }
-   aList := make([]tSearchEl, 0, len(aSet.Hits))
+   var aSort string
+   aPage.Offset, aSort = iState.getSearchPage()
+   aSet := _pageSearch(getService(iSvc).index, aQ, &aPage, aSort, aTabType != ePosForDefault)
    for _, aHit := range aSet.Hits {
-      aSubject := _i2slice(aHit.Fields["Subject"])
-      //aAuthor  := _i2slice(aHit.Fields["Author"])
-      //aTag     := _i2slice(aHit.Fields["Tag"])
-      aOrigCc  := _i2slice(aHit.Fields["OrigCc"])
-      aOrigCcSet := make([]string, len(aOrigCc))
-      for a := range aOrigCc { aOrigCcSet[a] = aOrigCc[a].(string) }
-      aLastSubjectN := int(aHit.Fields["LastSubjectN"].(float64))
-      aList = append(aList, tSearchEl{Id:         aHit.ID,
-                                      Count:      uint32(aHit.Fields["Count"].(float64)),
-                                      Subject:    aSubject[aLastSubjectN].(string),
-                                      OrigCc:     aOrigCcSet,
-                                      OrigDate:   aHit.Fields["OrigDate"].(string),
-                                      LastDate:   aHit.Fields["LastDate"].(string),
-                                      OrigAuthor: aHit.Fields["OrigAuthor"].(string),
-                                      LastAuthor: aHit.Fields["LastAuthor"].(string),
-                                      Unread:     aHit.Fields["Unread"].(bool)})
-      if aLastSubjectN != 0 {
-         aList[len(aList)-1].SubjectWas = aSubject[0].(string)
-      }
-   }
-   sort.Slice(aList, func(cA, cB int) bool { return aList[cA].LastDate > aList[cB].LastDate })
-   err = json.NewEncoder(iW).Encode(aList)
+      aPage.List = append(aPage.List, _makeElSearch(aHit))
+      if len(aHit.Locations) > 0 {
+         _setSnippetSearch(iSvc, &aPage.List[len(aPage.List)-1], aHit.Locations,
+                           int(aHit.Fields["LastSubjectN"].(float64)))
+      }
+   }
+   err = json.NewEncoder(iW).Encode(aPage)
    return err
 }
 
+// searches all services for iWords, and writes the page of results at iOffset
+// results from each service are merged in iSort order, with ties ordered by service
+func WriteResultGlobalSearch(iW io.Writer, iWords string, iOffset int, iSort string) error {
+   aPage := tSearchPage{Limit: sSearchLimit, List: []tSearchEl{}}
+   if strings.TrimSpace(iWords) == "" {
+      return json.NewEncoder(iW).Encode(aPage)
+   }
+   if iOffset > 0 {
+      aPage.Offset = iOffset
+   }
+   aOrder := kSearchSorts[iSort]; if aOrder == nil { aOrder = kSearchSorts[kSearchSortDefault] }
+   aQ := _makeWordsQuery(iWords)
+   type tHit struct { svc string; *pBsearch.DocumentMatch }
+   var aHits []tHit
+   sServicesDoor.RLock()
+   for aK, aV := range sServices {
+      if aV.index == nil { continue }
+      aSr := pBleve.NewSearchRequestOptions(aQ, aPage.Offset + aPage.Limit, 0, false)
+      aSr.Fields = kResultFields
+      aSr.Sort = aOrder
+      aSr.IncludeLocations = true
+      aSet, err := aV.index.Search(aSr)
+      if err != nil { quit(err) }
+      aPage.Total += aSet.Total
+      for _, aHit := range aSet.Hits {
+         aHits = append(aHits, tHit{aK, aHit})
+      }
+   }
+   sServicesDoor.RUnlock()
+   aScore, aDesc := aOrder.CacheIsScore(), aOrder.CacheDescending()
+   sort.Slice(aHits, func(cA, cB int) bool {
+      cCmp := aOrder.Compare(aScore, aDesc, aHits[cA].DocumentMatch, aHits[cB].DocumentMatch)
+      if cCmp != 0 {
+         return cCmp < 0
+      }
+      return aHits[cA].svc < aHits[cB].svc
+   })
+   if aPage.Offset >= len(aHits) {
+      aPage.Offset = 0; if len(aHits) > 0 { aPage.Offset = (len(aHits)-1) / aPage.Limit * aPage.Limit }
+   }
+   aHits = aHits[aPage.Offset:]
+   if len(aHits) > aPage.Limit {
+      aHits = aHits[:aPage.Limit]
+   }
+   for _, aHit := range aHits {
+      aEl := _makeElSearch(aHit.DocumentMatch)
+      aEl.Svc = aHit.svc
+      if len(aHit.Locations) > 0 {
+         _setSnippetSearch(aHit.svc, &aEl, aHit.Locations, int(aHit.Fields["LastSubjectN"].(float64)))
+      }
+      aPage.List = append(aPage.List, aEl)
+   }
+   return json.NewEncoder(iW).Encode(aPage)
+}
+
+// runs iQ for the page at ioPage.Offset, or the last page if that is past the end
+func _pageSearch(iBi pBleve.Index, iQ pBquery.Query, ioPage *tSearchPage, iSort string,
+                 iLocs bool) *pBleve.SearchResult {
+   aOrder := kSearchSorts[iSort]; if aOrder == nil { aOrder = kSearchSorts[kSearchSortDefault] }
+   if ioPage.Offset < 0 {
+      ioPage.Offset = 0
+   }
+   for {
+      aSr := pBleve.NewSearchRequestOptions(iQ, ioPage.Limit, ioPage.Offset, false)
+      aSr.Fields = kResultFields
+      aSr.Sort = aOrder
+      aSr.IncludeLocations = iLocs
+      aSet, err := iBi.Search(aSr)
+      if err != nil { quit(err) }
+      if len(aSet.Hits) > 0 || ioPage.Offset == 0 {
+         ioPage.Total = aSet.Total
+         return aSet
+      }
+      ioPage.Offset = 0; if aSet.Total > 0 { ioPage.Offset = int(aSet.Total-1) / ioPage.Limit * ioPage.Limit }
+   }
+}
+
+func _makeElSearch(iHit *pBsearch.DocumentMatch) tSearchEl {
+   aSubject := _i2slice(iHit.Fields["Subject"])
+   //aAuthor  := _i2slice(iHit.Fields["Author"])
+   //aTag     := _i2slice(iHit.Fields["Tag"])
+   aOrigCc  := _i2slice(iHit.Fields["OrigCc"])
+   aOrigCcSet := make([]string, len(aOrigCc))
+   for a := range aOrigCc { aOrigCcSet[a] = aOrigCc[a].(string) }
+   aLastSubjectN := int(iHit.Fields["LastSubjectN"].(float64))
+   aEl := tSearchEl{Id:         iHit.ID,
+                    Count:      uint32(iHit.Fields["Count"].(float64)),
+                    Subject:    aSubject[aLastSubjectN].(string),
+                    OrigCc:     aOrigCcSet,
+                    OrigDate:   iHit.Fields["OrigDate"].(string),
+                    LastDate:   iHit.Fields["LastDate"].(string),
+                    OrigAuthor: iHit.Fields["OrigAuthor"].(string),
+                    LastAuthor: iHit.Fields["LastAuthor"].(string),
+                    Unread:     iHit.Fields["Unread"].(bool)}
+   if aLastSubjectN != 0 {
+      aEl.SubjectWas = aSubject[0].(string)
+   }
+   return aEl
+}
+
+type tTermSpan struct { start, end int64 } // byte offsets
+
+// a damaged thread is recorded and yields no excerpts, so it doesn't abort the result page
+func _setSnippetSearch(iSvc string, iEl *tSearchEl, iLoc pBsearch.FieldTermLocationMap, iSubjectN int) {
+   defer func() { RecoverDamage(iSvc, recover()) }()
+   fSpans := func(cField string, cArrayN int) []tTermSpan {
+      var cSet []tTermSpan
+      for _, cList := range iLoc[cField] {
+         for _, cL := range cList {
+            if cArrayN >= 0 && len(cL.ArrayPositions) > 0 && cL.ArrayPositions[0] != uint64(cArrayN) { continue }
+            cSet = append(cSet, tTermSpan{int64(cL.Start), int64(cL.End)})
+         }
+      }
+      sort.Slice(cSet, func(cA, cB int) bool { return cSet[cA].start < cSet[cB].start })
+      return cSet
+   }
+   if aSpans := fSpans("Subject", iSubjectN); len(aSpans) > 0 {
+      iEl.SubjectSnippet = _markSearch([]byte(iEl.Subject), aSpans, false, false)
+   }
+   if aSpans := fSpans("Body", -1); len(aSpans) > 0 {
+      iEl.MatchIds, iEl.Snippets = snippetThread(iSvc, iEl.Id, aSpans)
+   }
+}
+
+// returns html of iText with iSpans marked; iSpans are sorted offsets into iText
+// iCutHead & iCutTail indicate an excerpt, which may begin or end with a partial character
+func _markSearch(iText []byte, iSpans []tTermSpan, iCutHead, iCutTail bool) string {
+   var aB strings.Builder
+   aPos, aEnd := int64(0), int64(len(iText))
+   if iCutHead {
+      aB.WriteString("\u2026")
+      for aPos < aEnd && !utf8.RuneStart(iText[aPos]) { aPos++ }
+   }
+   if iCutTail {
+      for aN := aEnd-1; aN >= aPos && aN >= aEnd - utf8.UTFMax; aN-- {
+         if !utf8.RuneStart(iText[aN]) { continue }
+         if !utf8.FullRune(iText[aN:aEnd]) { aEnd = aN }
+         break
+      }
+   }
+   fText := func(cEnd int64) string {
+      return html.EscapeString(strings.Map(func(c rune) rune {
+         if c == '\n' || c == '\r' || c == '\t' { return ' ' }
+         return c
+      }, string(iText[aPos:cEnd])))
+   }
+   for _, aS := range iSpans {
+      if aS.start < aPos || aS.end > aEnd { continue }
+      aB.WriteString(fText(aS.start))
+      aPos = aS.start
+      aB.WriteString("<mark>"+ fText(aS.end) +"</mark>")
+      aPos = aS.end
+   }
+   aB.WriteString(fText(aEnd))
+   if iCutTail {
+      aB.WriteString("\u2026")
+   }
+   return aB.String()
+}
+
 func _makeWordsQuery(iWords string) pBquery.Query {
+   if aTokSet := _tokenizeSearch(iWords); aTokSet != nil {
+      aN := 0
+      return _parseSearch(aTokSet, &aN)
+   }
    aWordSet := strings.Fields(iWords)
    if len(aWordSet) == 0 {
       return nil
@@ -187,6 +408,227 @@ func _makeWordsQuery(iWords string) pBquery.Query {
    return pBquery.NewBooleanQuery(aMust, aShld, aNot)
 }
 
+var kSearchFields = map[string]bool{"from":true, "cc":true, "tag":true, "subject":true,
+                                    "before":true, "after":true, "on":true, "has":true, "is":true,
+                                    "attachment":true}
+var kSearchDateUnits = map[byte][3]int{'d':{0,0,1}, 'w':{0,0,7}, 'm':{0,1,0}, 'y':{1,0,0}}
+var kSearchDateForms = []struct{ layout string; span [3]int }{
+   {"2006-01-02", [3]int{0,0,1}}, {"2006-01", [3]int{0,1,0}}, {"2006", [3]int{1,0,0}} }
+
+type tSearchTok struct {
+   kind byte // 'w' word, '(' or ')'
+   op byte // '+' or '-'
+   field, text string
+   phrase bool
+}
+
+// returns nil if iWords doesn't use field:value terms or parentheses
+func _tokenizeSearch(iWords string) []tSearchTok {
+   var aSet []tSearchTok
+   aFound := false
+   fEnd := func(cA int) int {
+      cN := strings.IndexAny(iWords[cA:], " \t\r\n()")
+      if cN < 0 { return len(iWords) }
+      return cA + cN
+   }
+   for a := 0; a < len(iWords); {
+      switch iWords[a] {
+      case ' ', '\t', '\r', '\n':
+         a++
+         continue
+      case ')':
+         aSet = append(aSet, tSearchTok{kind: ')'})
+         a++
+         continue
+      }
+      aTok := tSearchTok{kind: 'w'}
+      for ; a < len(iWords) && (iWords[a] == '+' || iWords[a] == '-'); a++ {
+         aTok.op = iWords[a]
+      }
+      if a < len(iWords) && iWords[a] == '(' {
+         aTok.kind = '('
+         aSet = append(aSet, aTok)
+         aFound = true
+         a++
+         continue
+      }
+      if aN := strings.IndexByte(iWords[a:fEnd(a)], ':'); aN > 0 && kSearchFields[strings.ToLower(iWords[a:a+aN])] {
+         aTok.field = strings.ToLower(iWords[a:a+aN])
+         aFound = true
+         a += aN + 1
+      }
+      if a < len(iWords) && iWords[a] == '"' {
+         aN := strings.IndexByte(iWords[a+1:], '"')
+         if aN < 0 { aN = len(iWords) - a - 1 }
+         aTok.text, aTok.phrase = iWords[a+1:a+1+aN], true
+         a += aN + 2
+      } else {
+         aN := fEnd(a)
+         aTok.text = iWords[a:aN]
+         a = aN
+      }
+      if aTok.text == "" && !aTok.phrase && aTok.field == "" { continue }
+      aSet = append(aSet, aTok)
+   }
+   if !aFound {
+      return nil
+   }
+   return aSet
+}
+
+// parses terms up to a closing paren or the end of iSet
+// plain words are optional but one must match; other terms are required unless OR'd
+func _parseSearch(iSet []tSearchTok, iN *int) pBquery.Query {
+   var aMust, aShld, aNot []pBquery.Query
+   var aLast *[]pBquery.Query
+   aOr := false
+   for *iN < len(iSet) {
+      aTok := iSet[*iN]
+      *iN++
+      if aTok.kind == ')' {
+         break
+      }
+      if aTok.kind == 'w' && aTok.op == 0 && aTok.field == "" && !aTok.phrase && aTok.text == "OR" {
+         aOr = aLast != nil
+         continue
+      }
+      var aQ pBquery.Query
+      aRef := &aMust
+      if aTok.kind == '(' {
+         aQ = _parseSearch(iSet, iN)
+      } else if aTok.field != "" {
+         aQ = _makeFieldQuery(aTok)
+      } else if !aTok.phrase && aTok.text[0] == '#' {
+         aQ = _makeFieldQuery(tSearchTok{field: "tag", text: aTok.text[1:]})
+      } else {
+         if aTok.phrase {
+            aQ = pBleve.NewMatchPhraseQuery(aTok.text)
+         } else {
+            aQ = pBquery.NewMatchQuery(aTok.text)
+         }
+         aRef = &aShld
+      }
+      if aOr {
+         if aTok.op == '-' {
+            aQ = pBquery.NewBooleanQuery([]pBquery.Query{pBleve.NewMatchAllQuery()}, nil, []pBquery.Query{aQ})
+         }
+         aPrev := &(*aLast)[len(*aLast)-1]
+         if aDq, ok := (*aPrev).(*pBquery.DisjunctionQuery); ok {
+            aDq.AddQuery(aQ)
+         } else {
+            *aPrev = pBleve.NewDisjunctionQuery(*aPrev, aQ)
+         }
+         aOr = false
+         continue
+      }
+      switch aTok.op {
+      case '+': aRef = &aMust
+      case '-': aRef = &aNot
+      }
+      *aRef = append(*aRef, aQ)
+      aLast = aRef
+      if aRef == &aNot {
+         aLast = nil // OR after a negated term is a plain word
+      }
+   }
+   if len(aMust) + len(aShld) == 0 {
+      if len(aNot) == 0 {
+         return pBleve.NewMatchNoneQuery()
+      }
+      aMust = append(aMust, pBleve.NewMatchAllQuery())
+   } else if len(aNot) == 0 && len(aMust) + len(aShld) == 1 {
+      return append(aMust, aShld...)[0]
+   }
+   aBq := pBquery.NewBooleanQuery(aMust, aShld, aNot)
+   if len(aShld) > 0 {
+      aBq.SetMinShould(1)
+   }
+   return aBq
+}
+
+func _makeFieldQuery(iTok tSearchTok) pBquery.Query {
+   fDate := func(cField string, cDate time.Time, cStart bool) pBquery.Query {
+      cIncl := cStart
+      var cQ *pBquery.DateRangeQuery
+      if cStart {
+         cQ = pBleve.NewDateRangeInclusiveQuery(cDate, time.Time{}, &cIncl, nil)
+      } else {
+         cQ = pBleve.NewDateRangeInclusiveQuery(time.Time{}, cDate, nil, &cIncl)
+      }
+      cQ.SetField(cField)
+      return cQ
+   }
+   switch iTok.field {
+   case "from", "cc", "subject", "attachment":
+      aQ := pBleve.NewMatchPhraseQuery(iTok.text)
+      switch iTok.field {
+      case "from":    aQ.SetField("Author")
+      case "cc":      aQ.SetField("Cc")
+      case "subject": aQ.SetField("Subject")
+      default:        aQ.SetField("Attachment")
+      }
+      return aQ
+   case "tag":
+      aTag := GetIdTag(iTok.text)
+      if aTag == "" {
+         break
+      }
+      return pBquery.NewPhraseQuery([]string{aTag}, "Tag")
+   case "before", "after", "on":
+      aStart, aEnd, ok := _parseDateSearch(iTok.text)
+      if !ok {
+         break
+      }
+      switch iTok.field {
+      case "before": return fDate("OrigTime", aStart, false)
+      case "after":  return fDate("LastTime", aStart, true)
+      }
+      return pBleve.NewConjunctionQuery(fDate("OrigTime", aEnd, false), fDate("LastTime", aStart, true))
+   case "has":
+      if strings.ToLower(iTok.text) != "attachment" {
+         break
+      }
+      aQb := pBleve.NewBoolFieldQuery(true)
+      aQb.SetField("Attach")
+      return aQb
+   case "is":
+      aText := strings.ToLower(iTok.text)
+      if aText != "unread" && aText != "read" {
+         break
+      }
+      aQb := pBleve.NewBoolFieldQuery(aText == "unread")
+      aQb.SetField("Unread")
+      return aQb
+   }
+   return pBleve.NewMatchNoneQuery()
+}
+
+// returns the local time span of a date (2006, 2006-01, 2006-01-02), a day N units ago
+// (Nd, Nw, Nm, Ny), today or yesterday
+func _parseDateSearch(iDate string) (time.Time, time.Time, bool) {
+   aNow := time.Now()
+   aDay := time.Date(aNow.Year(), aNow.Month(), aNow.Day(), 0, 0, 0, 0, time.Local)
+   switch strings.ToLower(iDate) {
+   case "today":     return aDay, aDay.AddDate(0, 0, 1), true
+   case "yesterday": return aDay.AddDate(0, 0, -1), aDay, true
+   }
+   if len(iDate) > 1 {
+      aUnit, ok := kSearchDateUnits[iDate[len(iDate)-1]]
+      aN, err := strconv.Atoi(iDate[:len(iDate)-1])
+      if ok && err == nil && aN >= 0 {
+         aStart := aDay.AddDate(-aN * aUnit[0], -aN * aUnit[1], -aN * aUnit[2])
+         return aStart, aStart.AddDate(0, 0, 1), true
+      }
+   }
+   for _, aF := range kSearchDateForms {
+      aT, err := time.ParseInLocation(aF.layout, iDate, time.Local)
+      if err == nil {
+         return aT, aT.AddDate(aF.span[0], aF.span[1], aF.span[2]), true
+      }
+   }
+   return time.Time{}, time.Time{}, false
+}
+
 func _i2slice(i interface{}) []interface{} { // bleve stores string for input []string{s}
    switch aV := i.(type) {
    case []interface{}: return aV
@@ -205,6 +647,57 @@ func countUnreadSearch(iSvc string) int {
    return int(aSet.Total)
 }
 
+type tSavedEl struct { // saved search
+   Name, Term string
+   ThreadN, UnreadN int // set by countSavedSearch()
+}
+
+// marks the counts of saved searches for update after an index change
+// they're counted on next read by _freshSaved(), so deliveries don't wait on searches
+func countSavedSearch(iSvc string) {
+   atomic.StoreInt32(&getService(iSvc).savedStale, 1)
+}
+
+// updates the thread & unread counts of saved searches if the index has changed
+// the caller must not hold iSvc's lock
+func _freshSaved(iSvc *tService) {
+   if !atomic.CompareAndSwapInt32(&iSvc.savedStale, 1, 0) {
+      return
+   }
+   iSvc.RLock()
+   aSet := append([]tSavedEl{}, iSvc.saved...)
+   iSvc.RUnlock()
+   if len(aSet) == 0 {
+      return
+   }
+   _countSaved(iSvc.index, aSet)
+   iSvc.Lock(); defer iSvc.Unlock()
+   for a := range iSvc.saved {
+      for a1 := range aSet {
+         if aSet[a1].Name == iSvc.saved[a].Name && aSet[a1].Term == iSvc.saved[a].Term {
+            iSvc.saved[a].ThreadN, iSvc.saved[a].UnreadN = aSet[a1].ThreadN, aSet[a1].UnreadN
+            break
+         }
+      }
+   }
+}
+
+func _countSaved(iBi pBleve.Index, ioSet []tSavedEl) {
+   fCount := func(cQ pBquery.Query) int {
+      cSr := pBleve.NewSearchRequestOptions(cQ, 0, 0, false)
+      cSet, err := iBi.Search(cSr)
+      if err != nil { quit(err) }
+      return int(cSet.Total)
+   }
+   aUnread := pBleve.NewBoolFieldQuery(true)
+   aUnread.SetField("Unread")
+   for a := range ioSet {
+      aQ := _makeWordsQuery(ioSet[a].Term)
+      ioSet[a].ThreadN = fCount(aQ)
+      ioSet[a].UnreadN = fCount(pBleve.NewConjunctionQuery(aQ, aUnread))
+   }
+}
+
 type tTermSites pBsearch.TermLocationMap
 
 var kTermSitesEmpty = tTermSites{}
@@ -249,6 +742,73 @@ func indexThreadSearch(iSvc string, iDoc *tSearchDoc, iI tIndexer) {
    iDoc.Body = string(aData)
    err = iI.Index(iDoc.id, iDoc)
    if err != nil { quit(err) }
+   if _, ok := iI.(*tReindex); !ok {
+      countSavedSearch(iSvc)
+   }
+}
+
+// returns names and text of the attachment files of thread iTid
+// text is extracted once per file name, size & mtime, and kept in the index via SetInternal()
+func attachTextSearch(iSvc string, iTid string, iI tIndexer) tStrings {
+   var err error
+   aKey := []byte(kSearchAttachKey + iTid)
+   aTx, _ := iI.(*tReindex)
+   var aBi pBleve.Index // holds prior text
+   if aTx != nil {
+      aBi = aTx.prior
+   } else {
+      aBi = getService(iSvc).index
+   }
+   aPrior := map[string]tAttachText{}
+   if aBi != nil {
+      var aJson []byte
+      aJson, err = aBi.GetInternal(aKey)
+      if err != nil { quit(err) }
+      if len(aJson) > 0 {
+         err = json.Unmarshal(aJson, &aPrior)
+         if err != nil { quit(err) }
+      }
+   }
+   aDir, err := readDirFis(dirAttach(iSvc) + iTid)
+   if err != nil && !os.IsNotExist(err) { quit(err) }
+   aNew := make(map[string]tAttachText, len(aDir))
+   aChanged := false
+   var aList tStrings
+   for _, aFi := range aDir {
+      if aFi.Name() == "ffnindex" { continue }
+      aName := unescapeFile(aFi.Name())
+      aName = aName[strings.IndexByte(aName, '_')+1:] // drop msgid; keep tag for textExtract()
+      aEl, ok := aPrior[aFi.Name()]
+      if !ok || aEl.Size != aFi.Size() || aEl.Mtime != aFi.ModTime().UnixNano() {
+         aEl = tAttachText{Size: aFi.Size(), Mtime: aFi.ModTime().UnixNano(),
+                           Text: textExtract(dirAttach(iSvc) + iTid +"/"+ aFi.Name(), aName)}
+         aChanged = true
+      }
+      aNew[aFi.Name()] = aEl
+      aList = append(aList, aName[2:])
+      if aEl.Text != "" {
+         aList = append(aList, aEl.Text)
+      }
+   }
+   if aTx == nil && !aChanged && len(aNew) == len(aPrior) {
+      return aList
+   }
+   if len(aNew) == 0 {
+      if aTx == nil {
+         err = aBi.DeleteInternal(aKey)
+         if err != nil { quit(err) }
+      }
+      return aList
+   }
+   aJson, err := json.Marshal(aNew)
+   if err != nil { quit(err) }
+   if aTx != nil {
+      aTx.SetInternal(aKey, aJson)
+   } else {
+      err = aBi.SetInternal(aKey, aJson)
+      if err != nil { quit(err) }
+   }
+   return aList
 }
 
 func updateUnreadSearch(iSvc string, iTid string, iUnread bool) {
@@ -259,11 +819,15 @@ func deleteThreadSearch(iSvc string, iTid string) {
    aBi := getService(iSvc).index
    err := aBi.Delete(iTid)
    if err != nil && err != pBleve.ErrorEmptyID { quit(err) }
+   err = aBi.DeleteInternal([]byte(kSearchAttachKey + iTid))
+   if err != nil { quit(err) }
+   countSavedSearch(iSvc)
 }
 
 func openIndexSearch(iCfg *tSvcConfig) pBleve.Index {
    aPath := fileIndex(iCfg.Name)
    aTemp := aPath + ".tmp"
+   aPrior := aPath + ".prior" // replaced index, whose attachment text _reindex() reuses
    err := os.RemoveAll(aTemp)
    if err != nil && !os.IsNotExist(err) { quit(err) }
    aBi, err := pBleve.Open(aPath)
@@ -271,10 +835,13 @@ func openIndexSearch(iCfg *tSvcConfig) pBleve.Index {
       var aRev []byte
       aRev, err = aBi.GetInternal([]byte{'v'})
       if err != nil { quit(err) }
-      if bytes.Compare(aRev, kSearchIndexRev) != 0 {
+      if bytes.Compare(aRev, _revSearch(iCfg)) != 0 { // new revision or analyzer; _reindex() below
+         fmt.Printf("openIndexSearch %s: index revision %s, need %s\n", iCfg.Name, aRev, _revSearch(iCfg))
          err = aBi.Close()
          if err != nil { quit(err) }
-         err = os.Rename(aPath, aTemp)
+         err = os.RemoveAll(aPrior)
+         if err != nil { quit(err) }
+         err = os.Rename(aPath, aPrior)
          if err != nil { quit(err) }
          aBi = openIndexSearch(iCfg)
       }
@@ -284,7 +851,7 @@ func openIndexSearch(iCfg *tSvcConfig) pBleve.Index {
    pBleve.Config.DefaultIndexType = pBscorch.Name
    aIm := pBleve.NewIndexMapping()
    aIm.TypeField = "type"
-   aIm.DefaultAnalyzer = "en"
+   aIm.DefaultAnalyzer = _analyzerSearch(iCfg)
 
    aFtext := pBleve.NewTextFieldMapping()
    aBtext := pBleve.NewTextFieldMapping()
@@ -294,41 +861,83 @@ func openIndexSearch(iCfg *tSvcConfig) pBleve.Index {
    aKtext := pBleve.NewTextFieldMapping()
    aKtext.Analyzer = pBkeyword.Name
    aKtext.Store = false
+   aOtime := pBleve.NewDateTimeFieldMapping() // stored datetime drops fractional seconds
+   aOtime.Name, aOtime.Store = "OrigTime", false
+   aLtime := pBleve.NewDateTimeFieldMapping()
+   aLtime.Name, aLtime.Store = "LastTime", false
+   aFnumr := pBleve.NewNumericFieldMapping()
    aNnumr := pBleve.NewNumericFieldMapping()
    aNnumr.Index = false
    aFbool := pBleve.NewBooleanFieldMapping()
 
    aThread := pBleve.NewDocumentMapping()
-   aThread.AddFieldMappingsAt("Count", aNnumr)
+   aThread.AddFieldMappingsAt("Count", aFnumr)
    aThread.AddFieldMappingsAt("Subject", aFtext)
    aThread.AddFieldMappingsAt("Author", aFtext)
    aThread.AddFieldMappingsAt("Tag", aKtext)
    aThread.AddFieldMappingsAt("OrigCc", aNtext)
-   aThread.AddFieldMappingsAt("OrigDate", aNtext)
-   aThread.AddFieldMappingsAt("LastDate", aNtext)
+   aThread.AddFieldMappingsAt("Cc", aBtext)
+   aThread.AddFieldMappingsAt("OrigDate", aNtext, aOtime)
+   aThread.AddFieldMappingsAt("LastDate", aNtext, aLtime)
    aThread.AddFieldMappingsAt("OrigAuthor", aNtext)
    aThread.AddFieldMappingsAt("LastAuthor", aNtext)
    aThread.AddFieldMappingsAt("LastSubjectN", aNnumr)
+   aThread.AddFieldMappingsAt("SubjectKey", aKtext)
    aThread.AddFieldMappingsAt("Unread", aFbool)
+   aThread.AddFieldMappingsAt("Attach", aFbool)
+   aThread.AddFieldMappingsAt("Attachment", aBtext)
    aThread.AddFieldMappingsAt("Body", aBtext)
    aIm.AddDocumentMapping("thread", aThread)
 
    aBi, err = pBleve.New(aTemp, aIm)
    if err != nil { quit(err) }
-   _reindex(iCfg, aBi)
+   aBp, err := pBleve.Open(aPrior)
+   if err != nil {
+      if err != pBleve.ErrorIndexPathDoesNotExist {
+         fmt.Fprintf(os.Stderr, "openIndexSearch %s: prior index %s\n", iCfg.Name, err.Error())
+      }
+      aBp = nil
+   }
+   _reindex(iCfg, aBi, aBp)
+   if aBp != nil {
+      err = aBp.Close()
+      if err != nil { quit(err) }
+   }
    err = aBi.Close()
    if err != nil { quit(err) }
    err = syncDir(aTemp) // in case bleve doesn't do so
    if err != nil { quit(err) }
    err = os.Rename(aTemp, aPath)
    if err != nil { quit(err) }
+   err = os.RemoveAll(aPrior)
+   if err != nil { quit(err) }
    aBi, err = pBleve.Open(aPath)
    if err != nil { quit(err) }
    return aBi
 }
 
-func _reindex(iCfg *tSvcConfig, iBi pBleve.Index) {
-   aTx := iBi.NewBatch()
+func _analyzerSearch(iCfg *tSvcConfig) string {
+   if iCfg.Analyzer == "" {
+      return kSearchAnalyzerDefault
+   }
+   if !kSearchAnalyzers[iCfg.Analyzer] {
+      fmt.Fprintf(os.Stderr, "_analyzerSearch %s: unknown analyzer %s\n", iCfg.Name, iCfg.Analyzer)
+      return kSearchAnalyzerDefault
+   }
+   return iCfg.Analyzer
+}
+
+// returns the index revision; a new analyzer makes a new revision, so the index is rebuilt
+func _revSearch(iCfg *tSvcConfig) []byte {
+   aAnlz := _analyzerSearch(iCfg)
+   if aAnlz == kSearchAnalyzerDefault {
+      return kSearchIndexRev
+   }
+   return []byte(string(kSearchIndexRev) +"/"+ aAnlz)
+}
+
+func _reindex(iCfg *tSvcConfig, iBi pBleve.Index, iPrior pBleve.Index) {
+   aTx := &tReindex{Batch: iBi.NewBatch(), prior: iPrior}
    aDir, err := readDirNames(dirThread(iCfg.Name))
    if err != nil { quit(err) }
    if len(aDir) > 0 {
@@ -336,16 +945,21 @@ func _reindex(iCfg *tSvcConfig, iBi pBleve.Index) {
    }
    for _, aFn := range aDir {
       if strings.ContainsRune(aFn[1:], '_') || strings.HasSuffix(aFn, ".bak") { continue }
-      var aFd *os.File
-      aFd, err = os.Open(dirThread(iCfg.Name) + aFn)
-      if err != nil { quit(err) }
-      _updateSearchDoc(iCfg.Name, iCfg, aFn, aFd, aTx)
-      aFd.Close()
+      _reindexThread(iCfg, aFn, aTx)
    }
    if len(aDir) > 0 {
       fmt.Printf(" done\n")
    }
-   aTx.SetInternal([]byte{'v'}, kSearchIndexRev)
-   err = iBi.Batch(aTx)
+   aTx.SetInternal([]byte{'v'}, _revSearch(iCfg))
+   err = iBi.Batch(aTx.Batch)
+   if err != nil { quit(err) }
+}
+
+// a damaged thread is moved to quarantine, so startup can proceed
+func _reindexThread(iCfg *tSvcConfig, iTid string, iI tIndexer) {
+   defer func() { quarantineThreadDamage(iCfg.Name, iTid, recover()) }()
+   aFd, err := os.Open(dirThread(iCfg.Name) + iTid)
    if err != nil { quit(err) }
+   defer aFd.Close()
+   _updateSearchDoc(iCfg.Name, iCfg, iTid, aFd, iI)
 }
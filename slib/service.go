@@ -20,6 +20,8 @@ import (
 
 const kServiceNameMin = 2
 const kServiceHistoryMax = 128
+const kSendHoldMax = 300 // seconds
+const kTmtpRev = 1 // protocol revision of this client
 
 type tGlobalService struct{}
 var Service tGlobalService
@@ -40,6 +42,10 @@ type tSvcConfig struct {
    Node string `json:",omitempty"`
    NodeSet []tNode
    Error string `json:",omitempty"` // from "registered" message
+   TmtpRev int `json:",omitempty"` // negotiated on "tmtprev" message
+   TmtpFeature []string `json:",omitempty"` // advertised by server
+   SendHold int `json:",omitempty"` // seconds before a sent draft is posted, for undo
+   Analyzer string `json:",omitempty"` // search language; index rebuilt on next startup
 }
 
 type tNode struct {
@@ -55,10 +61,10 @@ const ( eNodePending = 'p'; eNodeSent = 's'; eNodeAllowed = 'l'
 
 func initServices() {
    var err error
-   aSvcs, err := readDirNames(kServiceDir)
+   aSvcs, err := readDirNames(sServiceDir)
    if err != nil { quit(err) }
 
-   os.Remove(kStorageDir + "tags") //todo remove in 0.8
+   os.Remove(sStorageDir + "tags") //todo remove in 0.8
    for _, aSvc := range aSvcs {
       aSvc = unescapeFile(aSvc)
       if strings.HasSuffix(aSvc, ".tmp") {
@@ -101,7 +107,10 @@ func initServices() {
          } else if strings.HasPrefix(aTmp, "syncack_") {
             dropSyncNode(aSvc, aTmp[8+1:], aTmp[8:], "complete")
          } else {
-            completeThread(aSvc, aTmp)
+            func() {
+               defer func() { RecoverDamage(aSvc, recover()) }() // retry on next startup
+               completeThread(aSvc, aTmp)
+            }()
          }
       }
    }
@@ -113,21 +122,34 @@ func _openService(iSvc string) *tService {
       {fileCfg  (iSvc), &aService.config, true },
       {fileSendq(iSvc), &aService.sendQ,  false},
       {fileTab  (iSvc), &aService.tabs,   false},
+      {fileSaved(iSvc), &aService.saved,  false},
       {fileNotc (iSvc), &aService.notice, false},
       {filePing (iSvc), nil,              false},
       {fileOhi  (iSvc), nil,              false},
+      {fileAdrs (iSvc), nil,              false},
       {fileTag  (iSvc), &tTagset{},       false}, // last for initTag()
    }
    for a := range aSvcFiles {
       err := resolveTmpFile(aSvcFiles[a].name + ".tmp")
       if err != nil { quit(err) }
-      if aSvcFiles[a].cache != nil {
-         err = readJsonFile(aSvcFiles[a].cache, aSvcFiles[a].name)
-         if err != nil && (aSvcFiles[a].reqd || !os.IsNotExist(err)) { quit(err) }
+      aCache := aSvcFiles[a].cache
+      if aCache == nil {
+         aCache = &json.RawMessage{} // check syntax only
+      }
+      err = readJsonFile(aCache, aSvcFiles[a].name)
+      if err == nil || os.IsNotExist(err) && !aSvcFiles[a].reqd {
+         continue
+      }
+      if aSvcFiles[a].reqd { quit(err) }
+      quarantineDamage(iSvc, aSvcFiles[a].name, err)
+      if aSvcFiles[a].name != fileAdrs(iSvc) {
+         err = os.Symlink("empty", aSvcFiles[a].name) // as makeTreeService()
+         if err != nil { quit(err) }
       }
    }
    initTag(iSvc, * aSvcFiles[len(aSvcFiles)-1].cache.(*tTagset))
    aService.index = openIndexSearch(&aService.config)
+   aService.savedStale = 1
    if len(aService.config.NodeSet) == 0 { //todo drop in 0.8
       aService.config.NodeSet = []tNode{{Name:"first", Status:eNodeActive, Local:true}}
       err := storeFile(fileCfg(iSvc), &aService.config)
@@ -144,14 +166,20 @@ func startAllService() {
 }
 
 func (tGlobalService) GetIdx() interface{} {
-   type tSvcEl struct { Name string; NoticeN, UnreadN int }
+   type tSvcEl struct {
+      Name string
+      NoticeN, UnreadN int
+      Saved []tSavedEl `json:",omitempty"`
+   }
    sServicesDoor.RLock(); defer sServicesDoor.RUnlock()
    aS := make([]tSvcEl, 0, len(sServices))
    for aK, aV := range sServices {
+      _freshSaved(aV)
       aV.RLock()
       aN := -1
       for aN = 0; aN < len(aV.notice) && aV.notice[aN].Seen != 0; aN++ {}
-      aS = append(aS, tSvcEl{Name:aK, NoticeN: len(aV.notice) - aN, UnreadN: aV.unreadCount})
+      aS = append(aS, tSvcEl{Name:aK, NoticeN: len(aV.notice) - aN, UnreadN: aV.unreadCount,
+                             Saved: append([]tSavedEl(nil), aV.saved...)})
       aV.RUnlock()
    }
    sort.Slice(aS, func(cA, cB int) bool { return aS[cA].Name < aS[cB].Name })
@@ -307,10 +335,48 @@ func checkAddrService(iAddr string) (string, bool, error) {
    return iAddr[1:], iAddr[0] == '+', nil
 }
 
-func _setSiteData(iSvc string, iName string) {
+func _setSiteData(iSvc string, iName string, iRev int, iFeature []string, iErr error) {
    aSvc := getService(iSvc)
    aSvc.Lock(); defer aSvc.Unlock()
-   aSvc.siteData.Name = iName
+   aSvc.siteData.Name, aSvc.siteData.Rev, aSvc.siteData.Feature = iName, iRev, iFeature
+   aSvc.siteData.Error = ""
+   if iErr != nil {
+      aSvc.siteData.Error = iErr.Error()
+   }
+}
+
+func GetTmtpRevService() int { return kTmtpRev }
+
+// reports whether the last "tmtprev" message gave a supported revision
+func CheckTmtpRevService(iSvc string) bool {
+   aSvc := getService(iSvc)
+   aSvc.RLock(); defer aSvc.RUnlock()
+   return aSvc.siteData.Rev > 0
+}
+
+// returns the revision to use with a server that advertised iRev, and accepts iRevMin or later
+func negotiateTmtpRev(iRev, iRevMin int) (int, error) {
+   if iRev == 0 {
+      iRev = 1 // server predates negotiation
+   }
+   if iRevMin > kTmtpRev {
+      return 0, tError(fmt.Sprintf("server requires protocol revision %d or later; this client has %d",
+                                   iRevMin, kTmtpRev))
+   }
+   if iRev > kTmtpRev {
+      iRev = kTmtpRev
+   }
+   return iRev, nil
+}
+
+// reports whether the server advertised iFeature, so an op that needs it may be sent
+func HasFeatureService(iSvc string, iFeature string) bool {
+   aSvc := getService(iSvc)
+   aSvc.RLock(); defer aSvc.RUnlock()
+   for _, aF := range aSvc.config.TmtpFeature {
+      if aF == iFeature { return true }
+   }
+   return false
 }
 
 func GetSiteDataService(iSvc string) interface{} {
@@ -330,6 +396,13 @@ func GetConfigService(iSvc string) *tSvcConfig {
    return &aCfg
 }
 
+func GetSavedService(iSvc string) interface{} {
+   aSvc := getService(iSvc)
+   _freshSaved(aSvc)
+   aSvc.RLock(); defer aSvc.RUnlock()
+   return append([]tSavedEl{}, aSvc.saved...)
+}
+
 func GetCfService(iSvc string) interface{} {
    aSvc := getService(iSvc)
    aSvc.RLock(); defer aSvc.RUnlock()
@@ -422,8 +495,8 @@ func makeTreeService(iSvc string) {
       err = os.MkdirAll(aDir, 0700)
       if err != nil { quit(err) }
    }
-   for _, aFile := range [...]string{filePing(iSvc), fileOhi(iSvc), fileTab(iSvc), fileSendq(iSvc),
-                                     fileNotc(iSvc), fileTag(iSvc)} {
+   for _, aFile := range [...]string{filePing(iSvc), fileOhi(iSvc), fileTab(iSvc), fileSaved(iSvc),
+                                     fileSendq(iSvc), fileNotc(iSvc), fileTag(iSvc)} {
       err = os.Symlink("empty", aFile)
       if err != nil && !os.IsExist(err) { quit(err) }
    }
@@ -460,6 +533,36 @@ func dropTabService(iSvc string, iPos int) {
    if err != nil { quit(err) }
 }
 
+// adds or replaces the saved search named iName
+func addSavedService(iSvc string, iName, iTerm string) {
+   aSvc := getService(iSvc)
+   aSvc.Lock()
+   a := 0
+   for ; a < len(aSvc.saved) && aSvc.saved[a].Name != iName; a++ {}
+   if a == len(aSvc.saved) {
+      aSvc.saved = append(aSvc.saved, tSavedEl{})
+   }
+   aSvc.saved[a] = tSavedEl{Name: iName, Term: iTerm}
+   err := storeFile(fileSaved(iSvc), aSvc.saved)
+   if err != nil { quit(err) }
+   aSvc.Unlock()
+   countSavedSearch(iSvc)
+}
+
+func dropSavedService(iSvc string, iName string) error {
+   aSvc := getService(iSvc)
+   aSvc.Lock(); defer aSvc.Unlock()
+   for a := range aSvc.saved {
+      if aSvc.saved[a].Name == iName {
+         aSvc.saved = aSvc.saved[:a + copy(aSvc.saved[a:], aSvc.saved[a+1:])]
+         err := storeFile(fileSaved(iSvc), aSvc.saved)
+         if err != nil { quit(err) }
+         return nil
+      }
+   }
+   return tError("saved search not found: "+ iName)
+}
+
 func syncTagService(iSvc string, iTid, iMid string, iTagId []string) { //todo drop when draft sync'd
    if len(iTagId) == 0 {
       return
@@ -480,7 +583,7 @@ func sendAliasService(iW io.Writer, iSvc string, iQid, iId string) error {
    return err
 }
 
-func SendService(iW io.Writer, iSvc string, iSrec *SendRecord) error {
+func SendService(iW io.Writer, iSvc string, iSrec *SendRecord) (err error) {
    var aFn func(io.Writer, string, string, string) error
    switch iSrec.Id[0] {
    case eSrecOhi:    aFn = sendEditOhi
@@ -495,7 +598,15 @@ func SendService(iW io.Writer, iSvc string, iSrec *SendRecord) error {
    default:
       quit(tError("unknown op " + iSrec.Id[:1]))
    }
-   err := aFn(iW, iSvc, iSrec.Id[1:], iSrec.Id)
+   if !sendingQueue(iSvc, iSrec.Id) {
+      return tError("cancelled")
+   }
+   defer func() {
+      if aDmgErr := RecoverDamage(iSvc, recover()); aDmgErr != nil {
+         err = aDmgErr
+      }
+   }()
+   err = aFn(iW, iSvc, iSrec.Id[1:], iSrec.Id)
    if err != nil && err.Error() == "already sent" {
       dropQueue(iSvc, iSrec.Id)
    }
@@ -518,8 +629,22 @@ func HandleTmtpService(iSvc string, iHead *Header, iR io.Reader) (
 
    switch iHead.Op {
    case "tmtprev":
-      _setSiteData(iSvc, iHead.Name)
-      //todo check version
+      var aRev int
+      aRev, err = negotiateTmtpRev(iHead.Rev, iHead.RevMin)
+      _setSiteData(iSvc, iHead.Name, aRev, iHead.Feature, err)
+      if err != nil {
+         fmt.Fprintf(os.Stderr, "HandleTmtpService %s: %s\n", iSvc, err)
+         aFn, aResult = fAll, []string{"sd", "_e", err.Error()}
+         break
+      }
+      _editConfig(iSvc, func(cCfg *tSvcConfig) error {
+         if cCfg.TmtpRev == aRev && strings.Join(cCfg.TmtpFeature, " ") == strings.Join(iHead.Feature, " ") {
+            return tError("unchanged")
+         }
+         cCfg.TmtpRev, cCfg.TmtpFeature = aRev, iHead.Feature
+         return nil
+      })
+      aFn, aResult = fAll, []string{"sd"}
    case "registered":
       var aAlias, aUid string
       _editConfig(iSvc, func(cCfg *tSvcConfig) error {
@@ -637,12 +762,14 @@ func HandleTmtpService(iSvc string, iHead *Header, iR io.Reader) (
       }
       if aGot == "thread" {
          aFn, aResult = fAll, []string{"pt", "pf", "fl", "tl", "/v"}
+         aToAll = []string{"/v"}
       } else if aGot == "msg" {
          aFn = func(c *ClientState) []string {
             if c.getThread() == iHead.SubHead.ThreadId { return aResult }
             return aResult[:5]
          }
          aResult = []string{"pt", "pf", "fl", "tl", "/v", "al", "ml"}
+         aToAll = []string{"/v"}
       }
    case "notify":
       err = storeFwdNotifyThread(iSvc, iHead, iR)
@@ -796,11 +923,22 @@ func HandleSyncService(iSvc string, iHead *Header, iR io.Reader,
             aUpdates[a].Op = aUpdates[a].LogOp
          }
          aUpdates[a].log = eLogNone
-         iNotify(HandleUpdtService(iSvc, &aCs, &aUpdates[a]))
+         _handleSyncUpdt(iSvc, &aCs, &aUpdates[a], iNotify)
       }
    }
 }
 
+// applies one update from another node; damaged data it meets is recorded, and the rest continue
+func _handleSyncUpdt(iSvc string, iState *ClientState, iUpdt *Update,
+                     iNotify func(func(*ClientState)[]string, []string)) {
+   defer func() {
+      if RecoverDamage(iSvc, recover()) != nil {
+         iNotify(func(*ClientState) []string { return []string{"dl"} }, nil)
+      }
+   }()
+   iNotify(HandleUpdtService(iSvc, iState, iUpdt))
+}
+
 func HandleUpdtService(iSvc string, iState *ClientState, iUpdt *Update) (
                        aFn func(*ClientState)[]string, aToAll []string) {
    var err error
@@ -809,6 +947,13 @@ func HandleUpdtService(iSvc string, iState *ClientState, iUpdt *Update) (
    fOne := func(c *ClientState) []string { if c != iState { return nil }; return aResult }
    fErr := func(c *ClientState) []string { if c != iState { return nil }
                                            return []string{"_e", iUpdt.Op +" "+ err.Error()} }
+   defer func() {
+      aDmgErr := RecoverDamage(iSvc, recover())
+      if aDmgErr == nil { return }
+      aFn = func(c *ClientState) []string { if c != iState { return []string{"dl"} }
+                                            return []string{"dl", "_e", iUpdt.Op +" "+ aDmgErr.Error()} }
+      aToAll = nil
+   }()
 
    if iUpdt.Op != "open" {
       if iSvc == "local" {
@@ -825,14 +970,14 @@ func HandleUpdtService(iSvc string, iState *ClientState, iUpdt *Update) (
    switch iUpdt.Op {
    case "open":
       aResult = []string{"sd", "cf", "cn", "of", "ot", "ps", "pt", "pf", "gl",
-                         "fl", "tl", "cs", "cl", "al", "_t", "ml", "mo",
+                         "fl", "tl", "ss", "cs", "cl", "al", "_t", "ml", "mo",
                          "/v", "/t", "/f", "/g", "/l",
                          "_e", ""}
       aLen := len(aResult) - 2
       if iSvc == "local" {
-         aFn, aResult = fOne, aResult[17:aLen]
+         aFn, aResult = fOne, aResult[18:aLen]
       } else {
-         //todo aToAll return []string{"/v"} to update .UnreadN everywhere? (also thread_open & delivery)
+         //todo aToAll return []string{"/v"} to update .UnreadN everywhere?
          _initUnreadCount(iSvc)
          aCfg := GetConfigService(iSvc)
          if aCfg.Error != "" {
@@ -840,6 +985,10 @@ func HandleUpdtService(iSvc string, iState *ClientState, iUpdt *Update) (
             aResult[aLen-1] = aCfg.Error
          }
          aFn, aResult = fOne, aResult[:aLen]
+         if aDmg := listDamage(iSvc); len(aDmg) > 0 {
+            aResult = append(aResult, "dl", "_e", "damaged, restore from backup or discard: "+
+                                                  strings.Join(aDmg, ", "))
+         }
       }
    case "site_add":
       var aAddr string
@@ -859,6 +1008,10 @@ func HandleUpdtService(iSvc string, iState *ClientState, iUpdt *Update) (
          err = tError("address requires prefix + or =")
          return fErr, nil
       }
+      if iUpdt.Config.Analyzer != "" && !kSearchAnalyzers[iUpdt.Config.Analyzer] {
+         err = tError("unknown search analyzer "+ iUpdt.Config.Analyzer)
+         return fErr, nil
+      }
       if iUpdt.log == 0 && iUpdt.Config.Alias != "" {
          addQueue(iSvc, eSrecAlias, iUpdt.Config.Alias)
       }
@@ -871,6 +1024,12 @@ func HandleUpdtService(iSvc string, iState *ClientState, iUpdt *Update) (
             if iUpdt.Config.LoginPeriod >= 0 {
                cCfg.LoginPeriod = iUpdt.Config.LoginPeriod
             }
+            if iUpdt.Config.SendHold >= 0 && iUpdt.Config.SendHold <= kSendHoldMax {
+               cCfg.SendHold = iUpdt.Config.SendHold
+            }
+            if iUpdt.Config.Analyzer != "" {
+               cCfg.Analyzer = iUpdt.Config.Analyzer
+            }
             if iUpdt.Config.HistoryLen >= 4 && iUpdt.Config.HistoryLen <= 1024 {
                cCfg.HistoryLen = iUpdt.Config.HistoryLen
                iState.setHistoryMax(cCfg.HistoryLen)
@@ -890,11 +1049,55 @@ func HandleUpdtService(iSvc string, iState *ClientState, iUpdt *Update) (
       deleteDraftAdrsbk(iSvc, iUpdt.Ping.To, iUpdt.Ping.Gid)
       aFn, aResult = fAll, []string{"ps"}
    case "ping_send":
-      addQueue(iSvc, eSrecPing, iUpdt.Ping.Qid)
+      var aDue string
+      aDue, err = checkDueQueue(iUpdt)
+      if err != nil { return fErr, nil }
+      addDueQueue(iSvc, eSrecPing, iUpdt.Ping.Qid, aDue, false)
       aFn, aResult = fAll, []string{"ps"}
    case "accept_send":
       addQueue(iSvc, eSrecAccept, iUpdt.Accept.Qid)
       aFn, aResult = fAll, []string{"pf"}
+   case "queue_retry", "queue_cancel":
+      if iUpdt.Queue == nil || iUpdt.Queue.Id == "" {
+         err = tError("queue id missing")
+         return fErr, nil
+      }
+      if iUpdt.Op == "queue_retry" {
+         err = retryQueue(iSvc, iUpdt.Queue.Id)
+      } else {
+         err = cancelQueue(iSvc, iUpdt.Queue.Id)
+      }
+      if err != nil { return fErr, nil }
+      aFn, aResult = fAll, []string{"ml", "ps", "pf", "cl"}
+   case "damage_discard":
+      if iUpdt.Damage == nil || iUpdt.Damage.Object == "" {
+         err = tError("damage object missing")
+         return fErr, nil
+      }
+      err = discardDamage(iSvc, iUpdt.Damage.Object)
+      if err != nil { return fErr, nil }
+      aFn, aResult = fAll, []string{"dl", "fl", "tl", "cs", "cl", "al", "_t", "ml", "mo"}
+   case "thread_import":
+      if iUpdt.Import == nil || iUpdt.Import.Upload == "" {
+         err = tError("upload name missing")
+         return fErr, nil
+      }
+      aPath := fileUpload(iUpdt.Import.Upload)
+      _, err = os.Stat(aPath)
+      if err != nil { return fErr, nil }
+      aTag := &Update{Op:"tag_add"} // synced to other nodes as if from a client
+      aTag.Tag = &struct{ Name string; Id string `json:",omitempty"` }{kImportTag, GetIdTag(kImportTag)}
+      if aTag.Tag.Id == "" || mustCopyTag(iSvc, aTag.Tag.Id) != "" {
+         if aTag.Tag.Id == "" {
+            aTag.Tag.Id = makeIdTag()
+         }
+         syncUpdtNode(iSvc, aTag, iState, func() error {
+            addTag(iSvc, aTag.Tag.Name, aTag.Tag.Id)
+            return nil
+         })
+         aToAll = []string{"/g"}
+      }
+      startImport(iSvc, aPath, iUpdt.Import.Upload, aTag.Tag.Id)
    case "adrsbk_search":
       if iUpdt.Adrsbk.Term == "" {
          err = tError("search term missing")
@@ -969,13 +1172,20 @@ func HandleUpdtService(iSvc string, iState *ClientState, iUpdt *Update) (
       if iUpdt.Thread.Id == "" { break }
       err = validateDraftThread(iSvc, iUpdt)
       if err != nil { return fErr, nil }
+      var aDue string
+      aDue, err = checkDueQueue(iUpdt)
+      if err != nil { return fErr, nil }
       aTid := iState.getThread()
       aFn = func(c *ClientState) []string {
          if c.getThread() == aTid { return aResult }
          return nil
       }
       aResult = []string{"ml"}
-      addQueue(iSvc, eSrecThread, iUpdt.Thread.Id)
+      if aHold := GetConfigService(iSvc).SendHold; aDue == "" && aHold > 0 {
+         addHoldQueue(iSvc, eSrecThread, iUpdt.Thread.Id, aHold)
+      } else {
+         addDueQueue(iSvc, eSrecThread, iUpdt.Thread.Id, aDue, false)
+      }
    case "thread_open":
       if iUpdt.log == 0 && iUpdt.Touch.ThreadId != iState.getThread() {
          err = tError("thread id out of sync")
@@ -995,6 +1205,7 @@ func HandleUpdtService(iSvc string, iState *ClientState, iUpdt *Update) (
          return aResult[:2]
       }
       aResult = []string{"tl", "/v", "ml"}
+      aToAll = []string{"/v"}
    case "thread_seen_sync":
       touchThread(iSvc, iUpdt)
       aFn = func(c *ClientState) []string {
@@ -1039,12 +1250,15 @@ func HandleUpdtService(iSvc string, iState *ClientState, iUpdt *Update) (
       }
       aResult = []string{"cl"}
    case "forward_send":
+      var aDue string
+      aDue, err = checkDueQueue(iUpdt)
+      if err != nil { return fErr, nil }
       aFn = func(c *ClientState) []string {
          if c.getThread() == iUpdt.Forward.ThreadId { return aResult }
          return nil
       }
       aResult = []string{"cl"}
-      addQueue(iSvc, eSrecFwd, iUpdt.Forward.Qid)
+      addDueQueue(iSvc, eSrecFwd, iUpdt.Forward.Qid, aDue, false)
    case "tag_add":
       if iUpdt.log == 0 {
          iUpdt.Tag.Id = makeIdTag()
@@ -1056,6 +1270,8 @@ func HandleUpdtService(iSvc string, iState *ClientState, iUpdt *Update) (
       if err != nil { return fErr, nil }
       aToAll = []string{"/g"}
    case "navigate_thread":
+      _, err = os.Lstat(dirThread(iSvc) + iUpdt.Navigate.ThreadId) // may be discarded
+      if err != nil { return fErr, nil }
       aDiff := iUpdt.Navigate.ThreadId != iState.getThread()
       iState.addThread(iUpdt.Navigate.ThreadId)
       aFn = fOne
@@ -1098,7 +1314,30 @@ func HandleUpdtService(iSvc string, iState *ClientState, iUpdt *Update) (
       aFn, aResult = fOne, []string{"cs", aAlt}
    case "sort_select":
       iState.setSort(iUpdt.Sort.Type, iUpdt.Sort.Field)
-      aFn, aResult = fOne, []string{"cs"}
+      aFn, aResult = fOne, []string{"cs"}; if iUpdt.Sort.Type == "tl" { aResult = []string{"cs", "tl"} }
+   case "page_select":
+      iState.setSearchPage(iUpdt.Page.Offset)
+      aFn, aResult = fOne, []string{"tl"}
+   case "saved_add", "saved_drop":
+      if iUpdt.Saved == nil || iUpdt.Saved.Name == "" {
+         err = tError("saved search name missing")
+         return fErr, nil
+      }
+      if iUpdt.Op == "saved_add" && strings.TrimSpace(iUpdt.Saved.Term) == "" {
+         err = tError("saved search term missing")
+         return fErr, nil
+      }
+      syncUpdtNode(iSvc, iUpdt, iState, func() error {
+         if iUpdt.Op == "saved_drop" {
+            err = dropSavedService(iSvc, iUpdt.Saved.Name)
+            return err
+         }
+         addSavedService(iSvc, iUpdt.Saved.Name, iUpdt.Saved.Term)
+         return nil
+      })
+      if err != nil { return fErr, nil }
+      aFn, aResult = fAll, []string{"ss"}
+      aToAll = []string{"/v"}
    case "node_add":
       aNd := _findNode(iSvc, iUpdt.Node.Newnode)
       aIsNew := aNd == nil
@@ -1138,7 +1377,7 @@ func HandleUpdtService(iSvc string, iState *ClientState, iUpdt *Update) (
 
 // only for testing
 func WipeDataService(iSvc string) error {
-   aCfgTmp := kStorageDir +"svc-"+ escapeFile(iSvc) +"-config"
+   aCfgTmp := sStorageDir +"svc-"+ escapeFile(iSvc) +"-config"
    err := os.Rename(fileCfg(iSvc), aCfgTmp)
    if err != nil { return err }
    err = os.RemoveAll(dirSvc(iSvc))
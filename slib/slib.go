@@ -24,25 +24,39 @@ import (
    "net/url"
 )
 
-const kStorageDir = "store/"
-const kServiceDir = kStorageDir + "svc/"
-const kStateDir   = kStorageDir + "state/"
-const kUploadDir  = kStorageDir + "upload/"
-const kUploadTmp  = kUploadDir  + "temp/"
-const kFormDir    = kStorageDir + "form/"
-const kFormRegDir = kStorageDir + "reg-cache/"
-const kTempDir    = kStorageDir + "temp/"
+// these are fixed before Init; see SetStorageDir()
+var sStorageDir = "store/"
+var sServiceDir = sStorageDir + "svc/"
+var sStateDir   = sStorageDir + "state/"
+var sUploadDir  = sStorageDir + "upload/"
+var sUploadTmp  = sUploadDir  + "temp/"
+var sFormDir    = sStorageDir + "form/"
+var sFormRegDir = sStorageDir + "reg-cache/"
+var sTempDir    = sStorageDir + "temp/"
 
-func fileState(iCli, iSvc string) string { return kStateDir + iCli +"/"+ escapeFile(iSvc) }
+func SetStorageDir(iDir string) {
+   if iDir == "" { return }
+   if iDir[len(iDir)-1] != '/' { iDir += "/" }
+   sStorageDir = iDir
+   sServiceDir = sStorageDir + "svc/"
+   sStateDir   = sStorageDir + "state/"
+   sUploadDir  = sStorageDir + "upload/"
+   sUploadTmp  = sUploadDir  + "temp/"
+   sFormDir    = sStorageDir + "form/"
+   sFormRegDir = sStorageDir + "reg-cache/"
+   sTempDir    = sStorageDir + "temp/"
+}
+
+func fileState(iCli, iSvc string) string { return sStateDir + iCli +"/"+ escapeFile(iSvc) }
 
-func fileUpload(iFil string) string { return kUploadDir + escapeFile(iFil) }
-func fileUptmp (iFil string) string { return kUploadTmp + escapeFile(iFil) }
+func fileUpload(iFil string) string { return sUploadDir + escapeFile(iFil) }
+func fileUptmp (iFil string) string { return sUploadTmp + escapeFile(iFil) }
 
-func fileFormReg(iFfn string) string { return kFormRegDir + escapeFile(iFfn) }
+func fileFormReg(iFfn string) string { return sFormRegDir + escapeFile(iFfn) }
 
-func fileTemp(iFil string) string { return kTempDir + escapeFile(iFil) }
+func fileTemp(iFil string) string { return sTempDir + escapeFile(iFil) }
 
-func dirSvc(iSvc string) string { return kServiceDir + escapeFile(iSvc) + "/" }
+func dirSvc(iSvc string) string { return sServiceDir + escapeFile(iSvc) + "/" }
 
 // node.go uses some of these literals
 func dirTemp  (iSvc string) string { return dirSvc(iSvc) + "temp/" }
@@ -55,6 +69,7 @@ func fileAdrs (iSvc string) string { return dirSvc(iSvc) + "adrsbk" }
 func fileOhi  (iSvc string) string { return dirSvc(iSvc) + "ohi" }
 func fileTag  (iSvc string) string { return dirSvc(iSvc) + "tag" }
 func fileTab  (iSvc string) string { return dirSvc(iSvc) + "tabs" }
+func fileSaved(iSvc string) string { return dirSvc(iSvc) + "saved" }
 func fileSendq(iSvc string) string { return dirSvc(iSvc) + "sendq" }
 func fileNotc (iSvc string) string { return dirSvc(iSvc) + "notice" }
 func fileIndex(iSvc string) string { return dirSvc(iSvc) + "index.bleve" }
@@ -102,6 +117,7 @@ var kCrc32c = crc32.MakeTable(crc32.Castagnoli)
 var sTrySiteFn func(string, string, string, bool)
 var sServiceStartFn func(string)
 var sMsgToSelfFn func(string, *Header)
+var sToAllFn func([]string)
 var sCrashFn func(string, string)
 var sLocalId = time.Now().UnixNano() / 1e6 // milliseconds
 
@@ -118,14 +134,21 @@ type tService struct {
    adrsbk tAdrsbk
    index pBleve.Index
    toNode tToNode
+   savedStale int32 // atomic; saved search counts need update
    sync.RWMutex // protects the following
    config tSvcConfig
-   siteData struct { Name string }
+   siteData struct {
+      Name string
+      Rev int // negotiated protocol revision
+      Feature []string `json:",omitempty"`
+      Error string `json:",omitempty"`
+   }
    sendQ []*tQueueEl
    sendQPost func(...*SendRecord)
    notice []tNoticeEl
    fromOhi tOhi
    tabs []tTermEl
+   saved []tSavedEl
    unreadCount int
    doors map[string]tDoor // shared by *Thread & *FilledForm
    // fileOhi(svc), not cached
@@ -140,6 +163,8 @@ type Header struct {
    Op string
    Error string
    Name string
+   Rev, RevMin int
+   Feature []string
    Auth byte
    AuthBy []tAuthBy
    Id, MsgId, PostId string
@@ -176,6 +201,7 @@ type tHeader2 struct {
    ConfirmPosted string `json:",omitempty"`
    NodeSync bool `json:",omitempty"`
    noAttachSize bool
+   imported bool // store as seen
 }
 
 type tHeader2Attach struct {
@@ -227,6 +253,8 @@ type Update struct {
       Addr string
       Alias string
       LoginPeriod int
+      SendHold int
+      Analyzer string
    } `json:",omitempty"`
    Thread *struct {
       Id string
@@ -254,6 +282,16 @@ type Update struct {
    Accept *struct {
       Qid string
    } `json:",omitempty"`
+   Queue *struct {
+      Id string `json:",omitempty"` // SendRecord.Id
+      Due string `json:",omitempty"` // scheduled send date, RFC3339
+   } `json:",omitempty"`
+   Damage *struct {
+      Object string
+   } `json:",omitempty"`
+   Import *struct {
+      Upload string // mbox file in uploads
+   } `json:",omitempty"`
    Adrsbk *struct {
       Type int8
       Term string
@@ -284,9 +322,17 @@ type Update struct {
       Type string
       Field string
    } `json:",omitempty"`
+   Page *struct {
+      Offset int
+   } `json:",omitempty"`
+   Saved *struct {
+      Name string
+      Term string
+   } `json:",omitempty"`
    Node *struct {
       Addr string
       Pin string
+      Cert string // fingerprint, needed if Addr has "https://" prefix
       Newnode string
    } `json:",omitempty"`
    Test *UpdateTest `json:",omitempty"`
@@ -320,12 +366,13 @@ type Msg map[string]interface{}
 
 
 func Init(iTry func(string, string, string, bool), iStart func(string), iMts func(string, *Header),
-          iCrash func(string, string)) {
-   sTrySiteFn, sServiceStartFn, sMsgToSelfFn, sCrashFn = iTry, iStart, iMts, iCrash
-   for _, aDir := range [...]string{kUploadTmp, kServiceDir, kStateDir, kFormDir, kFormRegDir, kTempDir} {
+          iToAll func([]string), iCrash func(string, string)) {
+   sTrySiteFn, sServiceStartFn, sMsgToSelfFn, sToAllFn, sCrashFn = iTry, iStart, iMts, iToAll, iCrash
+   for _, aDir := range [...]string{sUploadTmp, sServiceDir, sStateDir, sFormDir, sFormRegDir, sTempDir} {
       err := os.MkdirAll(aDir, 0700)
       if err != nil { quit(err) }
    }
+   initAccess()
    initUpload()
    initForms()
    initStates()
@@ -423,7 +470,7 @@ func readJsonFile(iObj interface{}, iPath string) error {
    }
    defer aFd.Close()
    err = json.NewDecoder(aFd).Decode(iObj)
-   if err != nil && err != io.ErrUnexpectedEOF {
+   if err != nil && err != io.ErrUnexpectedEOF && err != io.EOF {
       if _, ok := err.(*json.SyntaxError); !ok { quit(err) }
    }
    return err
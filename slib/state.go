@@ -19,7 +19,7 @@ import (
    "net/url"
 )
 
-var kSortDefault = tSummarySort{Cc:"Who", Atc:"Date", Upload:"Date", Form:"Date"}
+var kSortDefault = tSummarySort{Cc:"Who", Atc:"Date", Upload:"Date", Form:"Date", Search:kSearchSortDefault}
 var kSvcTabsDefault = []tTermEl{{"All",""}, {"Unread",""}, {"#Todo",""}}
 var kThreadTabsDefault = []tTermEl{{"Open",""}, {"All",""}}
 var kTabsStdService, kTabsStdThread string
@@ -36,17 +36,17 @@ func initStates() {
    if err != nil { quit(err) }
    kTabsStdThread = string(aBuf)
 
-   aClients, err := readDirNames(kStateDir)
+   aClients, err := readDirNames(sStateDir)
    if err != nil { quit(err) }
 
    for _, aDir := range aClients {
       var aStates []string
-      aStates, err = readDirNames(kStateDir + aDir)
+      aStates, err = readDirNames(sStateDir + aDir)
       if err != nil { quit(err) }
 
       for _, aFile := range aStates {
          if strings.HasSuffix(aFile, ".tmp") {
-            err = resolveTmpFile(kStateDir + aDir + "/" + aFile)
+            err = resolveTmpFile(sStateDir + aDir + "/" + aFile)
             if err != nil { quit(err) }
          }
       }
@@ -57,9 +57,9 @@ func OpenState(iClientId, iSvc string) *ClientState {
    var err error
    sStateDoor.Lock()
    if !sStates[iClientId] {
-      err = os.MkdirAll(kStateDir + iClientId, 0700)
+      err = os.MkdirAll(sStateDir + iClientId, 0700)
       if err != nil { quit(err) }
-      err = syncDir(kStateDir)
+      err = syncDir(sStateDir)
       if err != nil { quit(err) }
       sStates[iClientId] = true
    }
@@ -70,17 +70,21 @@ func OpenState(iClientId, iSvc string) *ClientState {
                           historyMax: GetConfigService(iSvc).HistoryLen,
                           id: iClientId, svc: iSvc, filePath: fileState(iClientId, iSvc)}
    aFd, err := os.Open(aState.filePath)
-   if err != nil {
+   if err == nil {
+      err = json.NewDecoder(aFd).Decode(aState)
+      aFd.Close()
+      if err == nil {
+         return aState
+      }
+      quarantineDamage(iSvc, aState.filePath, err)
+      aState = OpenState(iClientId, iSvc)
+   } else {
       if !os.IsNotExist(err) { quit(err) }
       err = os.Symlink("new_state", aState.filePath)
       if err == nil {
-         err = syncDir(kStateDir + iClientId)
+         err = syncDir(sStateDir + iClientId)
       }
       if err != nil && !os.IsExist(err) { quit(err) }
-   } else {
-      err = json.NewDecoder(aFd).Decode(aState)
-      aFd.Close()
-      if err != nil { quit(err) }
    }
    return aState
 }
@@ -95,13 +99,16 @@ type ClientState struct {
    History []string // thread id
    Thread map[string]*tThreadState // key thread id
    SvcTabs tTabs
-   UploadSort, FormSort string `json:",omitempty"`
+   SvcPage int `json:",omitempty"` // offset of search results
+   UploadSort, FormSort, SearchSort string `json:",omitempty"`
 }
 
 type tSiteData struct {
    Addr string
    Pending bool
    Name string
+   Rev int // negotiated protocol revision
+   Error string `json:",omitempty"`
    Auth byte
    AuthBy []tAuthBy
    verifier string
@@ -189,6 +196,7 @@ type tSummarySort struct {
    Atc    string `json:"al"`
    Upload string `json:"t"`
    Form   string `json:"f"`
+   Search string `json:"tl"`
 }
 
 type tSummaryTabs struct {
@@ -207,6 +215,7 @@ func (o *ClientState) GetSummary() interface{} {
                     SvcTabs: tSummaryTabs{Type: eTabService, tTabs: *o.SvcTabs.copy(), Pinned: &aPinned} }
    if o.UploadSort != "" { aS.Sort.Upload = o.UploadSort }
    if o.FormSort   != "" { aS.Sort.Form   = o.FormSort }
+   if o.SearchSort != "" { aS.Sort.Search = o.SearchSort }
 
    if o.Hpos >= 0 {
       aTs := o.Thread[o.History[o.Hpos]]
@@ -243,7 +252,7 @@ func (o *ClientState) ClearSite() {
    o.site = nil
 }
 
-func (o *ClientState) SetSiteData(iName string, iAuth byte, iAuthBy []tAuthBy) {
+func (o *ClientState) SetSiteData(iName string, iRev, iRevMin int, iAuth byte, iAuthBy []tAuthBy) {
    o.Lock(); defer o.Unlock()
    if o.site == nil {
       quit(tError("ClientState.SetSiteData: site empty"))
@@ -251,6 +260,12 @@ func (o *ClientState) SetSiteData(iName string, iAuth byte, iAuthBy []tAuthBy) {
    aS := o.site
    aS.Pending = false
    aS.Name, aS.Auth, aS.AuthBy = iName, iAuth, iAuthBy
+   var err error
+   aS.Rev, err = negotiateTmtpRev(iRev, iRevMin)
+   if err != nil {
+      aS.Error = err.Error()
+      aS.AuthBy = nil // cannot register
+   }
    if len(aS.AuthBy) == 0 {
       aS.Auth = 0
    } else if len(aS.AuthBy) > 26 { // limited by state parameter
@@ -321,6 +336,21 @@ func (o *ClientState) getSvcTab() (int8, string) {
    return o.SvcTabs.PosFor, aSet[o.SvcTabs.Pos].Term
 }
 
+// returns offset and sort field of search results
+func (o *ClientState) getSearchPage() (int, string) {
+   o.RLock(); defer o.RUnlock()
+   aSort := o.SearchSort; if aSort == "" { aSort = kSearchSortDefault }
+   return o.SvcPage, aSort
+}
+
+func (o *ClientState) setSearchPage(iOffset int) {
+   if iOffset < 0 { iOffset = 0 }
+   o.Lock(); defer o.Unlock()
+   o.SvcPage = iOffset
+   err := storeFile(o.filePath, o)
+   if err != nil { quit(err) }
+}
+
 func (o *ClientState) getThreadTab() (int8, string) {
    o.RLock(); defer o.RUnlock()
    aT := o.Thread[o.History[o.Hpos]]
@@ -467,6 +497,7 @@ func (o *ClientState) addTab(iType int8, iTerm string) {
    aTabs.Pos = len(aTabs.Terms)
    aTabs.PosFor = ePosForTerms
    aTabs.Terms = append(aTabs.Terms, *newTermEl(iTerm, ""))
+   if iType != eTabThread { o.SvcPage = 0 }
    err := storeFile(o.filePath, o)
    if err != nil { quit(err) }
 }
@@ -488,6 +519,7 @@ func (o *ClientState) setTab(iType int8, iPosFor int8, iPos int) {
 
    aTabs.PosFor = iPosFor
    aTabs.Pos = iPos
+   if iType != eTabThread { o.SvcPage = 0 }
    err := storeFile(o.filePath, o)
    if err != nil { quit(err) }
 }
@@ -533,6 +565,7 @@ func (o *ClientState) dropTab(iType int8) {
    if aFor == ePosForTerms {
       aTabs.Terms = aTabs.Terms[:aOrig + copy(aTabs.Terms[aOrig:], aTabs.Terms[aOrig+1:])]
    }
+   if iType != eTabThread { o.SvcPage = 0 }
    err := storeFile(o.filePath, o)
    if err != nil { quit(err) }
    if aFor == ePosForPinned {
@@ -545,6 +578,7 @@ func (o *ClientState) setSort(iType string, iField string) {
    switch iType {
    case "t":  o.UploadSort                        = iField
    case "f":  o.FormSort                          = iField
+   case "tl": o.SearchSort                        = iField; o.SvcPage = 0
    case "cl": o.Thread[o.History[o.Hpos]].CcSort  = iField
    case "al": o.Thread[o.History[o.Hpos]].AtcSort = iField
    default:
@@ -66,7 +66,12 @@ type tFwdEl struct {
 }
 
 func GetIdxThread(iSvc string, iState *ClientState) interface{} {
-   aIdx := []struct{ tIndexElCore; Queued bool }{}
+   aIdx := []struct{
+      tIndexElCore
+      Queued bool
+      Failed string `json:",omitempty"`
+      Due string `json:",omitempty"`
+   }{}
    aTid := iState.getThread()
    if aTid == "" { return aIdx }
    func() {
@@ -85,6 +90,10 @@ func GetIdxThread(iSvc string, iState *ClientState) interface{} {
    for a, _ := range aIdx {
       if aIdx[a].From == "" {
          aIdx[a].Queued = hasQueue(iSvc, eSrecThread, aIdx[a].Id)
+         aIdx[a].Due = dueQueue(iSvc, eSrecThread, aIdx[a].Id)
+         if aIdx[a].Queued {
+            aIdx[a].Failed = failedQueue(iSvc, eSrecThread, aIdx[a].Id)
+         }
       }
    }
    for a1, a2 := 0, len(aIdx)-1; a1 < a2; a1, a2 = a1+1, a2-1 {
@@ -97,6 +106,8 @@ func GetCcThread(iSvc string, iState *ClientState) interface{} {
    type tCcElFwd struct {
       tCcElCore
       Queued bool
+      Failed string `json:",omitempty"`
+      Due string `json:",omitempty"`
       Qid string `json:",omitempty"`
    }
    const ( eFwd = iota; eCc )
@@ -120,15 +131,23 @@ func GetCcThread(iSvc string, iState *ClientState) interface{} {
    }
    if !fReadCc() { return aCc }
 
-   aDoor := _getThreadDoor(iSvc, aTid + "_forward")
-   aDoor.RLock()
-   aFwd := _getFwd(iSvc, aTid, "")
-   aDoor.RUnlock()
+   aFwd := func() []tFwdEl {
+      cDoor := _getThreadDoor(iSvc, aTid + "_forward")
+      cDoor.RLock(); defer cDoor.RUnlock()
+      return _getFwd(iSvc, aTid, "")
+   }()
    for a := range aFwd {
       aN := eFwd; if hasQueue(iSvc, eSrecFwd, aFwd[a].Id) { aN = eCc }
-      aQid := ""; if aN == eFwd { aQid = aFwd[a].Id }
+      aFailed, aDue := "", ""
+      if aN == eCc {
+         aFailed = failedQueue(iSvc, eSrecFwd, aFwd[a].Id)
+      } else {
+         aDue = dueQueue(iSvc, eSrecFwd, aFwd[a].Id)
+      }
+      aQid := ""; if aN == eFwd || aFailed != "" { aQid = aFwd[a].Id }
       for a1 := range aFwd[a].Cc {
-         aCc[aN] = append(aCc[aN], tCcElFwd{tCcElCore:aFwd[a].Cc[a1].tCcElCore, Queued:aN==eCc, Qid:aQid})
+         aCc[aN] = append(aCc[aN], tCcElFwd{tCcElCore:aFwd[a].Cc[a1].tCcElCore, Queued:aN==eCc,
+                                            Failed:aFailed, Due:aDue, Qid:aQid})
       }
    }
 
@@ -236,6 +255,24 @@ func getAttachThread(iSvc string, iTid string, iIdx *[]tIndexElCore, iDir *[]os.
    return nil
 }
 
+// returns the index of thread iTid, or nil if not found
+func getIndexThread(iSvc string, iTid string) []tIndexElCore {
+   aDoor := _getThreadDoor(iSvc, iTid)
+   aDoor.RLock(); defer aDoor.RUnlock()
+   if aDoor.renamed {
+      return nil
+   }
+   aFd, err := os.Open(dirThread(iSvc) + iTid)
+   if err != nil {
+      if !os.IsNotExist(err) { quit(err) }
+      return nil
+   }
+   defer aFd.Close()
+   var aIdx []tIndexElCore
+   _readIndex(aFd, &aIdx, nil)
+   return aIdx
+}
+
 func sendDraftThread(iW io.Writer, iSvc string, iDraftId, iId string) error {
    aFd, err := os.Open(dirThread(iSvc) + iDraftId)
    if err != nil {
@@ -249,13 +286,14 @@ func sendDraftThread(iW io.Writer, iSvc string, iDraftId, iId string) error {
    aMh := _readMsgHead(aFd)
    aCc := aMh.SubHead.Cc
    if aCc == nil {
-      aDoor := _getThreadDoor(iSvc, aId.tid())
-      aDoor.RLock()
-      var aOfd *os.File
-      aOfd, err = os.Open(dirThread(iSvc) + aId.tid())
-      if err != nil { quit(err) }
-      _readCc(aOfd, &aCc)
-      aOfd.Close(); aDoor.RUnlock()
+      func() {
+         cDoor := _getThreadDoor(iSvc, aId.tid())
+         cDoor.RLock(); defer cDoor.RUnlock()
+         cOfd, err := os.Open(dirThread(iSvc) + aId.tid())
+         if err != nil { quit(err) }
+         defer cOfd.Close()
+         _readCc(cOfd, &aCc)
+      }()
    }
 
    aAttachLen := sizeDraftAttach(iSvc, &aMh.SubHead, aId) // revs subhead
@@ -336,7 +374,7 @@ func storeReceivedThread(iSvc string, iHead *Header, iR io.Reader) (string, erro
    aNewCc := iHead.SubHead.Cc; if aThreadId != aMsgId { aNewCc = nil }
    aCid := iHead.SubHead.ConfirmId
 
-   if iHead.From == GetConfigService(iSvc).Uid {
+   if iHead.From == GetConfigService(iSvc).Uid || iHead.SubHead.imported {
       aEl.Seen = eSeenLocal
    }
    aTd, err = os.OpenFile(aTemp, os.O_RDWR|os.O_CREATE|os.O_EXCL, 0600)
@@ -580,7 +618,7 @@ func touchThread(iSvc string, iUpdt *Update) bool {
       }
       aIdx[aIdxN].Tags = aIdx[aIdxN].Tags[:a + copy(aIdx[aIdxN].Tags[a:], aIdx[aIdxN].Tags[a+1:])]
    default:
-      quit(tError("unknown Update.Touch.Act: "+ string(iUpdt.Touch.Act)))
+      quit(tError("unknown Update.Touch.Act: "+ string(rune(iUpdt.Touch.Act))))
    }
    aTempOk += fmt.Sprint(aPos)
 
@@ -972,10 +1010,11 @@ func sendFwdDraftThread(iW io.Writer, iSvc string, iDraftId, iId string) error {
       return cFor
    }
 
-   aDoor := _getThreadDoor(iSvc, aId.tid() + "_forward")
-   aDoor.RLock()
-   aFwd := _getFwd(iSvc, aId.tid(), "exist")
-   aDoor.RUnlock()
+   aFwd := func() []tFwdEl {
+      cDoor := _getThreadDoor(iSvc, aId.tid() + "_forward")
+      cDoor.RLock(); defer cDoor.RUnlock()
+      return _getFwd(iSvc, aId.tid(), "exist")
+   }()
    for a := range aFwd {
       if aFwd[a].Id == iDraftId {
          aCc = aFwd[a].Cc
@@ -992,7 +1031,7 @@ func sendFwdDraftThread(iW io.Writer, iSvc string, iDraftId, iId string) error {
    aBufSubh, err := json.Marshal(&tHeader2{ThreadId:aId.tid()})
    if err != nil { quit(err) }
 
-   aDoor = _getThreadDoor(iSvc, aId.tid())
+   aDoor := _getThreadDoor(iSvc, aId.tid())
    aDoor.RLock(); defer aDoor.RUnlock()
 
    aFd, err := os.Open(dirThread(iSvc) + aId.tid())
@@ -1310,17 +1349,20 @@ func storeFwdDraftThread(iSvc string, iUpdt *Update) {
       }
    }
    var aCcOrig []tCcEl
-   aDoor := _getThreadDoor(iSvc, iUpdt.Forward.ThreadId)
-   aDoor.RLock()
-   aFd, err := os.Open(dirThread(iSvc) + iUpdt.Forward.ThreadId)
-   if err != nil { quit(err) }
-   _readCc(aFd, &aCcOrig)
-   aFd.Close(); aDoor.RUnlock()
+   func() {
+      cDoor := _getThreadDoor(iSvc, iUpdt.Forward.ThreadId)
+      cDoor.RLock(); defer cDoor.RUnlock()
+      cFd, err := os.Open(dirThread(iSvc) + iUpdt.Forward.ThreadId)
+      if err != nil { quit(err) }
+      defer cFd.Close()
+      _readCc(cFd, &aCcOrig)
+   }()
    fCheckInput(aCcOrig)
 
-   aDoor = _getThreadDoor(iSvc, iUpdt.Forward.ThreadId + "_forward")
+   aDoor := _getThreadDoor(iSvc, iUpdt.Forward.ThreadId + "_forward")
    aDoor.Lock(); defer aDoor.Unlock()
 
+   var err error
    aFwd := _getFwd(iSvc, iUpdt.Forward.ThreadId, "make")
    if len(aFwd) == 0 || hasQueue(iSvc, eSrecFwd, aFwd[len(aFwd)-1].Id) {
       aFwd = append(aFwd, tFwdEl{Id:makeLocalId(iUpdt.Forward.ThreadId)})
@@ -1367,7 +1409,7 @@ func _getFwd(iSvc string, iTid string, iOpt string) []tFwdEl {
    } else {
       err = json.NewDecoder(aFd).Decode(&aFwd)
       aFd.Close()
-      if err != nil { quit(err) }
+      if err != nil { damage(aPath, err) }
    }
    return aFwd
 }
@@ -1456,7 +1498,13 @@ func _updateSearchDoc(iSvc string, iCfg *tSvcConfig, iTid string, iFd *os.File,
    for a := 1; a < len(aCc) && aCc[a].Date == aCc[0].Date; a++ {
       aDoc.OrigCc.addUnique(aCc[a].Who)
    }
+   for a := range aCc {
+      aDoc.Cc.addUnique(aCc[a].Who)
+   }
+   aDoc.Attachment = attachTextSearch(iSvc, iTid, iI)
+   aDoc.Attach = len(aDoc.Attachment) > 0
    aSubj := aIdx[aLastSubjectN].Subject; if aSubj == "" { aSubj = aIdx[0].Subject }
+   aDoc.SubjectKey = strings.ToLower(aSubj)
    for a := range aDoc.Subject {
       if aDoc.Subject[a] != aSubj { continue }
       aDoc.LastSubjectN = a
@@ -1466,6 +1514,63 @@ func _updateSearchDoc(iSvc string, iCfg *tSvcConfig, iTid string, iFd *os.File,
    indexThreadSearch(iSvc, aDoc, iI)
 }
 
+// returns ids of messages with search terms at iSpans, and excerpts of their text
+// iSpans are sorted offsets into the search Body, which is read by tThreadStream
+func snippetThread(iSvc string, iTid string, iSpans []tTermSpan) ([]string, []string) {
+   aDoor := _getThreadDoor(iSvc, iTid)
+   aDoor.RLock(); defer aDoor.RUnlock()
+   if aDoor.renamed { return nil, nil }
+
+   aFd, err := os.Open(dirThread(iSvc) + iTid)
+   if err != nil {
+      if !os.IsNotExist(err) { quit(err) }
+      return nil, nil
+   }
+   defer aFd.Close()
+   var aIdx []tIndexEl
+   _readIndex(aFd, &aIdx, nil)
+   aIdx = _newThreadStream(iSvc, aIdx, aFd).idx // Body sequence
+   var aIds, aSnips []string
+   aBufHead := make([]byte, 4)
+   aBase, aS := int64(0), 0 // Body offset of message, first span in message
+   for a := 0; a < len(aIdx) && aS < len(iSpans); a++ {
+      aXd, aPos := aFd, aIdx[a].Offset
+      if aPos < 0 {
+         aXd, err = os.Open(dirThread(iSvc) + aIdx[a].Id)
+         if err != nil { quit(err) }
+         defer aXd.Close()
+         aPos = 0
+      }
+      _, err = aXd.ReadAt(aBufHead, aPos)
+      if err != nil { quit(err) }
+      aUi, _ := strconv.ParseUint(string(aBufHead), 16, 0)
+      aStart := aPos + 4 + int64(aUi) + 1
+      aLen := aPos + aIdx[a].Size - aStart
+      aN := aS
+      for aN < len(iSpans) && iSpans[aN].start < aBase + aLen { aN++ }
+      if aN > aS {
+         aIds = append(aIds, aIdx[a].Id)
+      }
+      for aS < aN && len(aSnips) < kSnippetMax {
+         aFrom := iSpans[aS].start - aBase - kSnippetContext; if aFrom < 0 { aFrom = 0 }
+         aTo := aS + 1
+         for aTo < aN && iSpans[aTo].end - aBase + kSnippetContext - aFrom <= kSnippetLenMax { aTo++ }
+         aEnd := iSpans[aTo-1].end - aBase + kSnippetContext; if aEnd > aLen { aEnd = aLen }
+         aText := make([]byte, aEnd - aFrom)
+         _, err = aXd.ReadAt(aText, aStart + aFrom)
+         if err != nil { quit(err) }
+         aLocal := make([]tTermSpan, 0, aTo - aS)
+         for ; aS < aTo; aS++ {
+            aLocal = append(aLocal, tTermSpan{iSpans[aS].start - aBase - aFrom, iSpans[aS].end - aBase - aFrom})
+         }
+         aSnips = append(aSnips, _markSearch(aText, aLocal, aFrom > 0, aEnd < aLen))
+      }
+      aS = aN
+      aBase += aLen
+   }
+   return aIds, aSnips
+}
+
 type tThreadStream struct {
    bufHead []byte
    svc string
@@ -1549,12 +1654,13 @@ func _readMsgHead(iFd *os.File) *tMsgHead {
    var aHead tMsgHead
    aBuf := make([]byte, 65536)
    _, err := iFd.Read(aBuf[:4])
-   if err != nil { quit(err) }
-   aUi, _ := strconv.ParseUint(string(aBuf[:4]), 16, 0)
+   if err != nil { damage(iFd.Name(), err) }
+   aUi, err := strconv.ParseUint(string(aBuf[:4]), 16, 0)
+   if err != nil { damage(iFd.Name(), tError("invalid header length")) }
    _, err = iFd.Read(aBuf[:aUi])
-   if err != nil { quit(err) }
+   if err != nil { damage(iFd.Name(), err) }
    err = json.Unmarshal(aBuf[:aUi], &aHead)
-   if err != nil { quit(err) }
+   if err != nil { damage(iFd.Name(), err) }
    _, err = iFd.Seek(1, io.SeekCurrent) // consume newline
    if err != nil { quit(err) }
    if aHead.Size == 0 && aHead.Len > 0 { // .Size added in 0.8
@@ -1568,21 +1674,21 @@ func _readMsgHead(iFd *os.File) *tMsgHead {
 func _readIndex(iFd *os.File, iIdx, iCc interface{}) int64 {
    aLenIdx, aLenCc := _readTail(iFd)
    aPos, err := iFd.Seek(-16 - aLenIdx - aLenCc, io.SeekEnd)
-   if err != nil { quit(err) }
+   if err != nil { damage(iFd.Name(), tError("index lengths exceed file size")) }
    if iIdx == nil {
       return aPos
    }
    aBuf := make([]byte, aLenIdx)
    _, err = iFd.Read(aBuf) //todo ensure all read
-   if err != nil { quit(err) }
+   if err != nil { damage(iFd.Name(), err) }
    err = json.Unmarshal(aBuf, iIdx)
-   if err != nil { quit(err) }
+   if err != nil { damage(iFd.Name(), err) }
    if iCc != nil {
       aBuf = make([]byte, aLenCc)
       _, err = iFd.Read(aBuf) //todo ensure all read
-      if err != nil { quit(err) }
+      if err != nil { damage(iFd.Name(), err) }
       err = json.Unmarshal(aBuf, iCc)
-      if err != nil { quit(err) }
+      if err != nil { damage(iFd.Name(), err) }
    }
    _, err = iFd.Seek(aPos, io.SeekStart)
    if err != nil { quit(err) }
@@ -1593,25 +1699,25 @@ func _readCc(iFd *os.File, iCc interface{}) (int64, int64) {
    aLenIdx, aLenCc := _readTail(iFd)
    aBuf := make([]byte, aLenCc)
    aPos, err := iFd.Seek(-16 - aLenCc, io.SeekEnd)
-   if err != nil { quit(err) }
+   if err != nil { damage(iFd.Name(), tError("cc length exceeds file size")) }
    _, err = iFd.Read(aBuf) //todo ensure all read
-   if err != nil { quit(err) }
+   if err != nil { damage(iFd.Name(), err) }
    err = json.Unmarshal(aBuf, iCc)
-   if err != nil { quit(err) }
+   if err != nil { damage(iFd.Name(), err) }
    return aPos, aLenIdx
 }
 
 func _readTail(iFd *os.File) (int64, int64) {
    aBuf := make([]byte, 16)
    _, err := iFd.Seek(-16, io.SeekEnd)
-   if err != nil { quit(err) }
+   if err != nil { damage(iFd.Name(), tError("file shorter than tail")) }
    _, err = iFd.Read(aBuf)
-   if err != nil { quit(err) }
+   if err != nil { damage(iFd.Name(), err) }
    aStr := string(aBuf)
    aLenIdx, err := strconv.ParseUint(aStr[:8], 16, 0)
-   if err != nil { quit(err) }
+   if err != nil { damage(iFd.Name(), tError("invalid tail")) }
    aLenCc,  err := strconv.ParseUint(aStr[8:], 16, 0)
-   if err != nil { quit(err) }
+   if err != nil { damage(iFd.Name(), tError("invalid tail")) }
    return int64(aLenIdx), int64(aLenCc)
 }
 
@@ -18,10 +18,10 @@ type tGlobalUpload struct{} // implements GlobalSet
 var Upload tGlobalUpload
 
 func initUpload() {
-   aFiles, err := readDirNames(kUploadTmp)
+   aFiles, err := readDirNames(sUploadTmp)
    if err != nil { quit(err) }
    for _, aFn := range aFiles {
-      err = renameRemove(kUploadTmp + aFn, kUploadDir + aFn)
+      err = renameRemove(sUploadTmp + aFn, sUploadDir + aFn)
       if err != nil { quit(err) }
    }
 }
@@ -33,7 +33,7 @@ type tUploadEl struct {
 }
 
 func (tGlobalUpload) GetIdx() interface{} {
-   aDir, err := readDirFis(kUploadDir)
+   aDir, err := readDirFis(sUploadDir)
    if err != nil { quit(err) }
    aList := make([]tUploadEl, 0, len(aDir)-1) // omit temp/
    for _, aFi := range aDir {
@@ -62,7 +62,7 @@ func (tGlobalUpload) Add(iId, iDup string, iR io.Reader) error {
    if err != nil {
       if !os.IsExist(err) { quit(err) }
    } else {
-      err = syncDir(kUploadDir)
+      err = syncDir(sUploadDir)
       if err != nil { quit(err) }
    }
    if iDup != "" {
@@ -77,7 +77,7 @@ func (tGlobalUpload) Add(iId, iDup string, iR io.Reader) error {
    }
    err = writeStreamFile(aTemp, iR)
    if err != nil { return err }
-   err = syncDir(kUploadTmp)
+   err = syncDir(sUploadTmp)
    if err != nil { quit(err) }
    err = os.Remove(aOrig)
    if err != nil { quit(err) }
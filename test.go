@@ -13,7 +13,9 @@ import (
    "bytes"
    "flag"
    "fmt"
+   "hash/crc32"
    "net/http"
+   "net/http/httptest"
    "io"
    "io/ioutil"
    "encoding/json"
@@ -50,7 +52,7 @@ var sTestExit = false
 
 type tTestClient struct {
    CountUtf8 []tTestSteppedRead
-   Formspec map[string]interface{} // one for all clients
+   Formspec map[string]interface{} // key ffn; one for all clients
    Version string
 
    Name string
@@ -201,7 +203,7 @@ func test() int {
       for a1 := range aClients[a].Orders {
          aOrder := &aClients[a].Orders[a1]
          for aK, aV := range aOrder.Result {
-            if aPrior, _ := aV.(string); aPrior != "" {
+            if aPrior, _ := aV.(string); aPrior != "" && aK != "_e" {
                aOrder.Result[aK] = aResultLib[aPrior][aK]
             }
          }
@@ -300,6 +302,32 @@ func _algorithms(iClient *tTestClient) bool {
    return true
 }
 
+// serves each of iSpecs at its ffn as a stand-in FFN registry, requiring revalidation via ETag
+func _startTestRegistry(iSpecs map[string]interface{}) {
+   aBufs := make(map[string][]byte, len(iSpecs)) // key path
+   for aFfn, aSpec := range iSpecs {
+      aBuf, err := json.Marshal(aSpec)
+      if err != nil { quit(err) }
+      aBufs["/"+ aFfn] = aBuf
+   }
+   aSrv := httptest.NewServer(http.HandlerFunc(func(cW http.ResponseWriter, cR *http.Request) {
+      cBuf := aBufs[cR.URL.Path]
+      if cBuf == nil {
+         http.NotFound(cW, cR)
+         return
+      }
+      cEtag := fmt.Sprintf(`"%x"`, crc32.ChecksumIEEE(cBuf))
+      cW.Header().Set("ETag", cEtag)
+      cW.Header().Set("Cache-Control", "no-cache")
+      if cR.Header.Get("If-None-Match") == cEtag {
+         cW.WriteHeader(http.StatusNotModified)
+         return
+      }
+      cW.Write(cBuf)
+   }))
+   pSl.SetRegistryForm(aSrv.URL +"/")
+}
+
 func _setupTestDir(iDir string, iClients []tTestClient) bool {
    var err error
 
@@ -310,7 +338,7 @@ func _setupTestDir(iDir string, iClients []tTestClient) bool {
    err = os.Symlink("../../web", "web")
    if err != nil { quit(err) }
 
-   pSl.Init(StartTrySite, StartService, MsgToSelf, crashTest)
+   pSl.Init(StartTrySite, StartService, MsgToSelf, ToAllClients, crashTest)
    pSl.ListenNode()
    aPin := pSl.GetPinNode(sNetAddr)
    sTestNodePin = aPin.Pin
@@ -320,14 +348,8 @@ func _setupTestDir(iDir string, iClients []tTestClient) bool {
    aEnc := json.NewEncoder(&aBuf)
    for a := range iClients {
       aTc = &iClients[a]
-      if aTc.Formspec != nil { //todo download spec
-         var aFd *os.File
-         aFd, err = os.Create("formspec")
-         if err != nil { quit(err) }
-         err = json.NewEncoder(aFd).Encode(aTc.Formspec)
-         if err != nil { quit(err) }
-         err = aFd.Close()
-         if err != nil { quit(err) }
+      if aTc.Formspec != nil {
+         _startTestRegistry(aTc.Formspec)
       }
       if aTc.Cfg.Name != "" {
          aTc.Cfg.Addr = "=" + sTestHost
@@ -429,7 +451,9 @@ func _setupTestCrash(iClients []tTestClient) (_ string, err error) {
       err = pSl.WipeDataService(iClients[a].SvcId)
       if err != nil { return }
    }
-   pSl.Init(StartTrySite, StartService, MsgToSelf, crashTest)
+   pSl.Init(StartTrySite, StartService, MsgToSelf, ToAllClients, crashTest)
+   pSl.ListenNode()
+   sTestNodePin = pSl.GetPinNode(sNetAddr).Pin
    if sServices[sTestCrashDst].queue == nil || sServices[sTestCrashSrc].queue == nil {
       return "", tError("invalid service")
    }
@@ -455,7 +479,7 @@ func _setupTestVerify(iClients []tTestClient) (_ string, err error) {
 
    err = os.Chdir(aArg[eDir])
    if err != nil { return }
-   pSl.Init(StartTrySite, StartService, MsgToSelf, crashTest)
+   pSl.Init(StartTrySite, StartService, MsgToSelf, ToAllClients, crashTest)
    if sServices[aArg[eSvc]].queue == nil {
       return "", tError("invalid service")
    }
@@ -556,7 +580,11 @@ func _runTestClient(iTc *tTestClient, iWg *sync.WaitGroup) {
       err = json.Unmarshal(aBuf, &aOps)
       if err != nil { quit(err) }
       if aOps[0] == "_e" {
-         fmt.Fprintf(os.Stderr, "%s update error %s\n", aPrefix, aOps[1])
+         if aExpect, ok := iTc.Orders[a].Result["_e"]; !ok {
+            fmt.Fprintf(os.Stderr, "%s update error %s\n", aPrefix, aOps[1])
+         } else if aExpect != aOps[1] {
+            fmt.Fprintf(os.Stderr, "%s mismatch\n  expect _e %v\n  got    _e %s\n", aPrefix, aExpect, aOps[1])
+         }
          continue
       }
       for aK, aV := range iTc.Orders[a].Result {
@@ -575,7 +603,7 @@ func _runTestClient(iTc *tTestClient, iWg *sync.WaitGroup) {
                break
             }
             if aOp == "_t" || aOp == "_T" { continue }
-            if aOp == "mn" || aOp == "an" {
+            if aOp == "mn" || aOp == "an" || aOp == "fq" {
                a1++
                aId = aOps[a1]
                if aSum != nil { atomic.AddInt32(aSum, 1) }
@@ -619,6 +647,8 @@ func _prepUpdt(iUpdt *pSl.Update, iCtx *tTestContext, iPrefix string) bool {
    case "site_add", "site_drop":
       if iUpdt.Site.Addr == "test" {
          iUpdt.Site.Addr = "="+ sTestHost
+      } else if iUpdt.Site.Addr == "test-rev" { // relay only
+         iUpdt.Site.Addr = "="+ kRelayAddrRevNext
       }
    case "config_update":
       if iUpdt.Config.Addr == "orig" {
@@ -706,7 +736,8 @@ func _prepUpdt(iUpdt *pSl.Update, iCtx *tTestContext, iPrefix string) bool {
         "notice_seen",
         "tag_add",
         "tab_add", "tab_pin", "tab_drop", "tab_select",
-        "sort_select",
+        "sort_select", "page_select",
+        "saved_add", "saved_drop",
         "open":
       // nothing to do
    case "test":
@@ -809,8 +840,10 @@ func _runTestService(iCtx *tTestContext, iOp, iId string, iExpect interface{},
       err = json.Unmarshal(aResult.Bytes(), &aClPair)
       if err != nil { return }
       *iCtx.lastId[iOp] = aClPair[0]
-   } else if iOp == "tl" && aResult.Bytes()[0] == '{' {
-      // nothing to do
+   } else if iOp == "tl" {
+      aPage := struct{ List *tTestAnyId }{iCtx.lastId[iOp]} // filled-form table has no List
+      err = json.Unmarshal(aResult.Bytes(), &aPage)
+      if err != nil { return }
    } else if iCtx.lastId[iOp] != nil {
       err = json.Unmarshal(aResult.Bytes(), iCtx.lastId[iOp])
       if err != nil { return }
@@ -831,6 +864,10 @@ func _runTestService(iCtx *tTestContext, iOp, iId string, iExpect interface{},
          aS := aGot.([]interface{})
          sort.Slice(aS, func(cA, cB int)bool { return aS[cA].(map[string]interface{})["Id"].(string) <
                                                       aS[cB].(map[string]interface{})["Id"].(string) })
+      } else if iOp == "/f" { // listed in map order
+         aS := aGot.([]interface{})
+         sort.Slice(aS, func(cA, cB int)bool { return aS[cA].(map[string]interface{})["Name"].(string) <
+                                                      aS[cB].(map[string]interface{})["Name"].(string) })
       }
    }
    if err != nil { return }
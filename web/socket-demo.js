@@ -13,7 +13,7 @@
    var sSvc = null;
    var sHlist = [], sHpos = -1;
    var sLocalId = 900000000000;
-   var sD = {'/v': [], '/t': [], '/f': [], '/g': [], '/l': {"Addr":"","Pin":""}, S: {}};
+   var sD = {'/v': [], '/t': [], '/f': [], '/g': [], '/l': {"Addr":"","Pin":"","Cert":""}, S: {}};
 
    mnm.demoId = location.search === '' ? 'local' : decodeURIComponent(location.search.slice(1));
 
@@ -75,6 +75,12 @@
    mnm.InviteAccept = function(i) {
       mnm.Err('invite accept not enabled in demo');
    };
+   mnm.QueueRetry = mnm.QueueCancel = function(i) {
+      mnm.Err('send queue not enabled in demo');
+   };
+   mnm.DamageDiscard = function(i) {
+      mnm.Err('damage discard not enabled in demo');
+   };
    mnm.AdrsbkSearch = function(iType, iTerm) {
       iTerm = iTerm.toLowerCase();
       var aFound = ['_n'];
@@ -225,6 +231,9 @@
    mnm.ThreadSend = function(iId) {
       mnm.Err('thread send not enabled in demo');
    };
+   mnm.ThreadImport = function(iUpload) {
+      mnm.Err('thread import not enabled in demo');
+   };
    mnm.ThreadDiscard = function(iId) {
       if (iId[0] === '_') {
          delete sSvc.T[iId];
@@ -336,8 +345,15 @@
       sSvc.cs.Sort[iType] = iField;
       _render('cs');
    };
+   mnm.PageSelect = function(iOffset) {
+      _render('tl');
+   };
+
+   mnm.SavedAdd = mnm.SavedDrop = function() {
+      mnm.Err('saved searches not enabled in demo');
+   };
 
-   mnm.NodeAdd = function(iAddr, iPin, iNewnode) {
+   mnm.NodeAdd = function(iAddr, iPin, iCert, iNewnode) {
       mnm.Err('replication not enabled in demo');
    };
 
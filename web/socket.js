@@ -8,7 +8,8 @@
 ;var mnm = {};
 
 (function() {
-   var sUrl = 'ws://'+ location.host +'/s/'+ location.pathname.split('/')[1];
+   var sUrl = (location.protocol === 'https:' ? 'wss://' : 'ws://')+ location.host +'/s/'+
+              location.pathname.split('/')[1];
    var sTouchSeen = 's'.charCodeAt(0);
    var sTouchTag = 't'.charCodeAt(0);
    var sTouchUntag = 'u'.charCodeAt(0);
@@ -48,12 +49,21 @@
    mnm.PingDiscard = function(iObj) { // with to, gid
       _wsSend({op:'ping_discard', ping:iObj})
    };
-   mnm.PingSend = function(i) {
-      _wsSend({op:'ping_send', ping:{qid:i}})
+   mnm.PingSend = function(i, iDue) { // iDue optional ISO date
+      _wsSend({op:'ping_send', ping:{qid:i}, queue:(iDue ? {due:iDue} : undefined)})
    };
    mnm.InviteAccept = function(i) {
       _wsSend({op:'accept_send', accept:{qid:i}})
    };
+   mnm.QueueRetry = function(i) { // SendRecord id
+      _wsSend({op:'queue_retry', queue:{id:i}})
+   };
+   mnm.QueueCancel = function(i) {
+      _wsSend({op:'queue_cancel', queue:{id:i}})
+   };
+   mnm.DamageDiscard = function(i) { // object path
+      _wsSend({op:'damage_discard', damage:{object:i}})
+   };
    mnm.AdrsbkSearch = function(iType, iTerm) {
       _wsSend({op:'adrsbk_search', adrsbk:{type:iType, term:iTerm}})
    };
@@ -94,12 +104,15 @@
       delete iObj.new // just in case
       _wsSend({op:'thread_save', thread:iObj})
    };
-   mnm.ThreadSend = function(iId) {
-      _wsSend({op:'thread_send', thread:{id:iId}})
+   mnm.ThreadSend = function(iId, iDue) { // iDue optional ISO date
+      _wsSend({op:'thread_send', thread:{id:iId}, queue:(iDue ? {due:iDue} : undefined)})
    };
    mnm.ThreadDiscard = function(iId) {
       _wsSend({op:'thread_discard', thread:{id:iId}})
    };
+   mnm.ThreadImport = function(iUpload) { // mbox file
+      _wsSend({op:'thread_import', import:{upload:iUpload}})
+   };
 
    mnm.ThreadOpen = function(iId) {
       _xhr('mn', iId, null, true) // sends thread_open from onload
@@ -117,8 +130,8 @@
    mnm.ForwardSave = function(iId, iCc) {
       _wsSend({op:'forward_save', forward:{threadId:iId, cc:iCc}})
    };
-   mnm.ForwardSend = function(iId, iQid) {
-      _wsSend({op:'forward_send', forward:{threadId:iId, qid:iQid}})
+   mnm.ForwardSend = function(iId, iQid, iDue) { // iDue optional ISO date
+      _wsSend({op:'forward_send', forward:{threadId:iId, qid:iQid}, queue:(iDue ? {due:iDue} : undefined)})
    };
 
    mnm.TagAdd = function(iName) {
@@ -141,9 +154,19 @@
    mnm.SortSelect = function(iType, iField) {
       _wsSend({op:'sort_select', sort:{type:iType, field:iField}})
    };
+   mnm.PageSelect = function(iOffset) {
+      _wsSend({op:'page_select', page:{offset:iOffset}})
+   };
+
+   mnm.SavedAdd = function(iName, iTerm) {
+      _wsSend({op:'saved_add', saved:{name:iName, term:iTerm}})
+   };
+   mnm.SavedDrop = function(iName) {
+      _wsSend({op:'saved_drop', saved:{name:iName}})
+   };
 
-   mnm.NodeAdd = function(iAddr, iPin, iNewnode) {
-      _wsSend({op:'node_add', node:{addr:iAddr, pin:iPin, newnode:iNewnode}})
+   mnm.NodeAdd = function(iAddr, iPin, iCert, iNewnode) {
+      _wsSend({op:'node_add', node:{addr:iAddr, pin:iPin, cert:iCert, newnode:iNewnode}})
    };
 
    mnm.FileForm = function(iId, iCb) {